@@ -6,9 +6,12 @@ import (
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/dns"
+	"github.com/ghokun/appletv3-iptv/internal/epg"
 	"github.com/ghokun/appletv3-iptv/internal/logging"
 	"github.com/ghokun/appletv3-iptv/internal/m3u"
 )
@@ -16,7 +19,7 @@ import (
 func errorHandler(w http.ResponseWriter, r *http.Request, err error) {
 	logging.Warn("Error at " + r.RequestURI + ". With details: " + err.Error())
 	GenerateErrorXML(w, r, ErrorData{
-		Title:       "Error",
+		Title:       "error.title",
 		Description: err.Error(),
 	})
 }
@@ -25,6 +28,16 @@ func unsupportedOperationHandler(w http.ResponseWriter, r *http.Request) {
 	errorHandler(w, r, errors.New("Unsupported operation"))
 }
 
+// BagHandler https://appletv.redbull.tv/bag.plist
+func BagHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		GenerateBagPlist(w, r)
+	default:
+		unsupportedOperationHandler(w, r)
+	}
+}
+
 // MainHandler https://appletv.redbull.tv
 func MainHandler(w http.ResponseWriter, r *http.Request) {
 	logging.CheckLogRotationAndRotate()
@@ -63,6 +76,26 @@ func ChannelOptionsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ChannelHandler https://appletv.redbull.tv/channel.xml?category=..&channel=..
+func ChannelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		category := r.URL.Query().Get("category")
+		channel := r.URL.Query().Get("channel")
+		value, err := m3u.GetPlaylist().GetChannel(category, channel)
+		if err != nil {
+			errorHandler(w, r, err)
+		} else {
+			GenerateXML(w, r, "templates/channel.xml", ChannelData{
+				Channel: value,
+				Health:  value.ProbeStream(r.Context()),
+			})
+		}
+	default:
+		unsupportedOperationHandler(w, r)
+	}
+}
+
 // RecentHandler https://appletv.redbull.tv/recent.xml
 func RecentHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -89,7 +122,7 @@ func ToggleFavoriteHandler(w http.ResponseWriter, r *http.Request) {
 	case "POST":
 		category := r.URL.Query().Get("category")
 		channel := r.URL.Query().Get("channel")
-		err := m3u.GetPlaylist().ToggleFavoriteChannel(category, channel)
+		err := m3u.ToggleFavoriteChannel(category, channel)
 		if err != nil {
 			errorHandler(w, r, err)
 		}
@@ -98,8 +131,47 @@ func ToggleFavoriteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// CategoryHandler https://appletv.redbull.tv/category.xml?category=..
+// ToggleProxyHandler https://appletv.redbull.tv/toggle-proxy.xml?category=..&channel=..
+func ToggleProxyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		category := r.URL.Query().Get("category")
+		channel := r.URL.Query().Get("channel")
+		err := m3u.ToggleProxiedChannel(category, channel)
+		if err != nil {
+			errorHandler(w, r, err)
+		}
+	default:
+		unsupportedOperationHandler(w, r)
+	}
+}
+
+// CategoryHandler https://appletv.redbull.tv/category.xml?category=..[&page=..]
+// Without page, first page is shown as preview of category list.
 func CategoryHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		category := r.URL.Query().Get("category")
+		value, err := m3u.GetPlaylist().GetCategory(category)
+		if err != nil {
+			errorHandler(w, r, err)
+			return
+		}
+		page := r.URL.Query().Get("page")
+		number, err := strconv.Atoi(page)
+		if page != "" && err != nil {
+			errorHandler(w, r, errors.New("Invalid page: "+page))
+			return
+		}
+		GenerateXML(w, r, "templates/category.xml", GetCategoryData(value, number, page == ""))
+	default:
+		unsupportedOperationHandler(w, r)
+	}
+}
+
+// CategoryIndexHandler https://appletv.redbull.tv/category-index.xml?category=..
+// A–Z index of category, jumps to page of selected letter.
+func CategoryIndexHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		category := r.URL.Query().Get("category")
@@ -107,24 +179,38 @@ func CategoryHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			errorHandler(w, r, err)
 		} else {
-			GenerateXML(w, r, "templates/category.xml", value)
+			GenerateXML(w, r, "templates/category-index.xml", GetCategoryData(value, 1, false))
 		}
 	default:
 		unsupportedOperationHandler(w, r)
 	}
 }
 
-// PlayerHandler https://appletv.redbull.tv/player.xml?category=..&channel=..
+// PlayerHandler https://appletv.redbull.tv/player.xml?category=..&channel=.. or player.xml?number=..
 func PlayerHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		category := r.URL.Query().Get("category")
 		channel := r.URL.Query().Get("channel")
+		// Channel number entered with remote
+		if value := r.URL.Query().Get("number"); value != "" {
+			number, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				errorHandler(w, r, errors.New("Invalid channel number: "+value))
+				return
+			}
+			numbered, err := m3u.GetPlaylist().GetChannelByNumber(number)
+			if err != nil {
+				errorHandler(w, r, err)
+				return
+			}
+			category, channel = numbered.CategoryID, numbered.ID
+		}
 		selectedChannel, err := m3u.GetPlaylist().GetChannel(category, channel)
 		if err != nil {
 			errorHandler(w, r, err)
 		} else {
-			err = m3u.GetPlaylist().SetRecentChannel(selectedChannel)
+			err = m3u.SetRecentChannel(category, channel)
 			if err != nil {
 				logging.Warn("Error while setting recent channel: " + selectedChannel.Title)
 			}
@@ -135,6 +221,42 @@ func PlayerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GuideHandler https://appletv.redbull.tv/guide.xml?category=..[&channel=..]&start=..[&page=..]
+func GuideHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		playlist := m3u.GetPlaylist()
+		category := r.URL.Query().Get("category")
+		if category == "" {
+			GenerateXML(w, r, "templates/guide.xml", GetGuideData(playlist, nil, "", time.Now(), 1))
+			return
+		}
+		value, err := playlist.GetCategory(category)
+		if err != nil {
+			errorHandler(w, r, err)
+			return
+		}
+		start := time.Now().Truncate(time.Hour)
+		if startParam := r.URL.Query().Get("start"); startParam != "" {
+			unix, err := strconv.ParseInt(startParam, 10, 64)
+			if err != nil {
+				errorHandler(w, r, err)
+				return
+			}
+			start = time.Unix(unix, 0)
+		}
+		page := r.URL.Query().Get("page")
+		number, err := strconv.Atoi(page)
+		if page != "" && err != nil {
+			errorHandler(w, r, errors.New("Invalid page: "+page))
+			return
+		}
+		GenerateXML(w, r, "templates/guide.xml", GetGuideData(playlist, &value, r.URL.Query().Get("channel"), start, number))
+	default:
+		unsupportedOperationHandler(w, r)
+	}
+}
+
 // SearchHandler https://appletv.redbull.tv/search.xml
 func SearchHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -150,7 +272,8 @@ func SearchResultsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		term := r.URL.Query().Get("term")
-		GenerateXML(w, r, "templates/search-results.xml", m3u.GetPlaylist().SearchChannels(term))
+		results := m3u.GetPlaylist().SearchChannels(term)
+		GenerateXML(w, r, "templates/search-results.xml", &results)
 	default:
 		unsupportedOperationHandler(w, r)
 	}
@@ -160,7 +283,7 @@ func SearchResultsHandler(w http.ResponseWriter, r *http.Request) {
 func SettingsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		GenerateXML(w, r, "templates/settings.xml", GetSettingsData())
+		GenerateXML(w, r, "templates/settings.xml", GetSettingsData(GetApp(r)))
 	default:
 		unsupportedOperationHandler(w, r)
 	}
@@ -189,39 +312,65 @@ func ReloadChannelsHandler(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		GenerateXML(w, r, "templates/reload-channels.xml", nil)
 	case "POST":
-		logging.Info("Reloading channels...")
-		logging.Info("Previous channel count is: " + strconv.Itoa(m3u.GetPlaylist().GetChannelsCount()))
-		logging.Info("Previous recent channel count is: " + strconv.Itoa(m3u.GetPlaylist().GetRecentChannelsCount()))
-		logging.Info("Previous favorite count is: " + strconv.Itoa(m3u.GetPlaylist().GetFavoriteChannelsCount()))
-		recentChannels := m3u.GetPlaylist().GetRecentChannels()
-		favoriteChannels := m3u.GetPlaylist().GetFavoriteChannels()
-		err := m3u.GeneratePlaylist()
-		for _, recent := range recentChannels {
-			channel, err := m3u.GetPlaylist().GetChannel(recent.CategoryID, recent.ID)
-			if err == nil {
-				channel.IsRecent = true
-				err = m3u.GetPlaylist().SetRecentChannel(channel)
-				if err != nil {
-					logging.Warn("Error while setting recent channel: " + channel.Title)
-				}
+		// Recent and favorite channels are restored from config file
+		err := m3u.ReloadPlaylist()
+		if err != nil {
+			errorHandler(w, r, err)
+			return
+		}
+		go func() {
+			err := epg.GenerateGuide(m3u.GetPlaylist().GetEPGPath())
+			if err != nil {
+				logging.Warn(err)
+			}
+		}()
+	default:
+		unsupportedOperationHandler(w, r)
+	}
+}
+
+// ToggleSourceHandler https://appletv.redbull.tv/toggle-source.xml?source=...
+func ToggleSourceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		name := r.URL.Query().Get("source")
+		enabled := false
+		for _, source := range config.Current.GetSources() {
+			if source.Name == name {
+				enabled = source.Disabled
 			}
 		}
-		for _, favorite := range favoriteChannels {
-			_, err := m3u.GetPlaylist().GetChannel(favorite.CategoryID, favorite.ID)
-			if err == nil {
-				err = m3u.GetPlaylist().ToggleFavoriteChannel(favorite.CategoryID, favorite.ID)
+		err := m3u.SetSourceEnabled(name, enabled)
+		if err != nil {
+			logging.Warn("Error while toggling source " + name + ": " + err.Error())
+		} else {
+			logging.Info("Toggled source " + name + ", enabled: " + strconv.FormatBool(enabled))
+			go func() {
+				err := epg.GenerateGuide(m3u.GetPlaylist().GetEPGPath())
 				if err != nil {
-					logging.Warn("Error while setting favorite channel: " + favorite.ID)
+					logging.Warn(err)
 				}
-			}
+			}()
 		}
+		http.Redirect(w, r, "/settings.xml", http.StatusSeeOther)
+	default:
+		unsupportedOperationHandler(w, r)
+	}
+}
+
+// ToggleLanguageHandler https://appletv.redbull.tv/toggle-language.xml
+// Switches to next language, after the last one language is detected from Apple TV again.
+func ToggleLanguageHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		language := nextLocale(config.Current.GetLanguage())
+		err := config.Current.SaveLanguage(language)
 		if err != nil {
-			errorHandler(w, r, err)
+			logging.Warn("Error while setting language: " + err.Error())
+		} else {
+			logging.Info("Setting language to: " + getLocaleName(language))
 		}
-		logging.Info("Reloaded channels.")
-		logging.Info("Channel count after reload is: " + strconv.Itoa(m3u.GetPlaylist().GetChannelsCount()))
-		logging.Info("Recent Channel count after reload is: " + strconv.Itoa(m3u.GetPlaylist().GetRecentChannelsCount()))
-		logging.Info("Favorite Channel count after reload is: " + strconv.Itoa(m3u.GetPlaylist().GetFavoriteChannelsCount()))
+		http.Redirect(w, r, "/settings.xml", http.StatusSeeOther)
 	default:
 		unsupportedOperationHandler(w, r)
 	}
@@ -231,7 +380,7 @@ func ReloadChannelsHandler(w http.ResponseWriter, r *http.Request) {
 func ClearRecentHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		err := m3u.GetPlaylist().ClearRecentChannels()
+		err := m3u.ClearRecentChannels()
 		if err != nil {
 			logging.Warn("Error while clearing recently watched channels.")
 		} else {
@@ -247,7 +396,7 @@ func ClearRecentHandler(w http.ResponseWriter, r *http.Request) {
 func ClearFavoritesHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		err := m3u.GetPlaylist().ClearFavoriteChannels()
+		err := m3u.ClearFavoriteChannels()
 		if err != nil {
 			logging.Warn("Error while clearing favorite channels.")
 		} else {
@@ -259,6 +408,32 @@ func ClearFavoritesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ClearLogoCacheHandler https://appletv.redbull.tv/clear-logo-cache.xml
+func ClearLogoCacheHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		err := m3u.ClearLogoCache()
+		if err != nil {
+			logging.Warn("Error while clearing logo cache. " + err.Error())
+		} else {
+			logging.Info("Cleared logo cache.")
+		}
+		http.Redirect(w, r, "/settings.xml", http.StatusSeeOther)
+	default:
+		unsupportedOperationHandler(w, r)
+	}
+}
+
+// BlockedLookupsHandler https://appletv.redbull.tv/blocked-lookups.xml
+func BlockedLookupsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		GenerateXML(w, r, "templates/blocked-lookups.xml", dns.GetBlockedLookups())
+	default:
+		unsupportedOperationHandler(w, r)
+	}
+}
+
 // LogsHandler https://appletv.redbull.tv/logs.xml
 func LogsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
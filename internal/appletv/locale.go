@@ -0,0 +1,165 @@
+package appletv
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/logging"
+	"golang.org/x/text/language"
+)
+
+const (
+	localesDir = "locales/"
+	// Missing keys of other locales are taken from default locale
+	defaultLocale = "en-US"
+)
+
+var (
+	// Locales are file names in templates/locales, default locale first. Found again when templates are loaded.
+	locales = findLocales()
+	matcher = newMatcher(locales)
+)
+
+// findLocales lists translation files, adding a <locale>.json file is enough to support a language.
+func findLocales() []string {
+	found := []string{defaultLocale}
+	entries, err := fs.ReadDir(templateFS, strings.TrimSuffix(localesDir, "/"))
+	if err != nil {
+		return found
+	}
+	for _, entry := range entries {
+		locale := strings.TrimSuffix(entry.Name(), ".json")
+		if locale != entry.Name() && locale != defaultLocale {
+			found = append(found, locale)
+		}
+	}
+	return found
+}
+
+// newMatcher matches Accept-Language header with locales, first locale is used if none matches.
+func newMatcher(locales []string) language.Matcher {
+	var tags []language.Tag
+	for _, locale := range locales {
+		tags = append(tags, language.Make(locale))
+	}
+	return language.NewMatcher(tags)
+}
+
+// isLocale - Is there a translation file for given locale?
+func isLocale(locale string) bool {
+	for _, value := range locales {
+		if value == locale {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLocale returns locale of page. Language in config takes precedence, otherwise it is matched with
+// Accept-Language header of Apple TV.
+func GetLocale(r *http.Request) string {
+	if language := config.Current.GetLanguage(); isLocale(language) {
+		return language
+	}
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	_, index, _ := matcher.Match(tags...)
+	return locales[index]
+}
+
+// readTranslations reads translation file of a single locale.
+func readTranslations(locale string) (translations map[string]string, err error) {
+	file, err := fs.ReadFile(templateFS, localesDir+locale+".json")
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(file, &translations)
+	return translations, err
+}
+
+// GetTranslations returns translations of given locale, read once at startup unless templates are reloaded.
+func GetTranslations(locale string) (translations map[string]string, err error) {
+	if !reloadTemplates {
+		if translations, ok := translationCache[locale]; ok {
+			return translations, nil
+		}
+	}
+	return readLocale(locale)
+}
+
+// readLocale reads translations of given locale. Keys that are missing or empty in locale are taken from
+// default locale, which is used entirely if translation file of locale can not be read.
+func readLocale(locale string) (translations map[string]string, err error) {
+	translations, err = readTranslations(defaultLocale)
+	if err != nil || locale == defaultLocale {
+		return translations, err
+	}
+	localized, err := readTranslations(locale)
+	if err != nil {
+		logging.Warn("Translations of " + locale + " could not be read. " + err.Error())
+		return translations, nil
+	}
+	for key, value := range localized {
+		if value != "" {
+			translations[key] = value
+		}
+	}
+	return translations, nil
+}
+
+// getLocaleName returns name of locale in its own language, e.g. Türkçe.
+func getLocaleName(locale string) string {
+	if !isLocale(locale) {
+		return locale
+	}
+	translations, err := GetTranslations(locale)
+	if err != nil || translations["locale.name"] == "" {
+		return locale
+	}
+	return translations["locale.name"]
+}
+
+// nextLocale returns locale that comes after given one in Settings, empty locale means automatic.
+func nextLocale(locale string) string {
+	for i, value := range locales {
+		if value == locale && i+1 < len(locales) {
+			return locales[i+1]
+		}
+	}
+	if locale == "" {
+		return locales[0]
+	}
+	return ""
+}
+
+// CheckTranslations logs translation files that can not be read and keys that are missing in them.
+func CheckTranslations() {
+	defaults, err := readTranslations(defaultLocale)
+	if err != nil {
+		logging.Warn("Translations of " + defaultLocale + " could not be read. " + err.Error())
+		return
+	}
+	for _, locale := range locales[1:] {
+		translations, err := readTranslations(locale)
+		if err != nil {
+			logging.Warn("Translations of " + locale + " could not be read. " + err.Error())
+			continue
+		}
+		var missing []string
+		for key := range defaults {
+			if translations[key] == "" {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			logging.Warn("Translations of " + locale + " are missing, " + defaultLocale + " is used instead: " + strings.Join(missing, ", "))
+		}
+	}
+	if config.Current.Language != "" && !isLocale(config.Current.Language) {
+		logging.Warn("Language " + config.Current.Language + " is not supported, it is detected from Apple TV instead. Supported languages: " + strings.Join(locales, ", "))
+	}
+}
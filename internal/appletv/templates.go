@@ -0,0 +1,82 @@
+package appletv
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/ghokun/appletv3-iptv/internal/logging"
+)
+
+const templatesDir = "templates/"
+
+var (
+	// Templates are read from embedded files, or from disk if a template directory is given
+	templateFS, _ = fs.Sub(templates, strings.TrimSuffix(templatesDir, "/"))
+	// Parsed once at startup, unless templates are reloaded on every request
+	templateCache    map[string]*template.Template
+	translationCache map[string]map[string]string
+	reloadTemplates  bool
+)
+
+// LoadTemplates parses all templates and reads translations of all locales, so that broken templates are
+// found at startup. If dir is not empty, templates and translations are read from dir on every request
+// instead, which is useful while editing them.
+func LoadTemplates(dir string) (err error) {
+	if dir != "" {
+		templateFS = os.DirFS(dir)
+		reloadTemplates = true
+		logging.Info("Templates are reloaded from " + dir + " on every request")
+	}
+	locales = findLocales()
+	matcher = newMatcher(locales)
+
+	files, err := fs.ReadDir(templateFS, ".")
+	if err != nil {
+		return err
+	}
+	parsed := make(map[string]*template.Template)
+	for _, file := range files {
+		name := templatesDir + file.Name()
+		if file.IsDir() || name == baseXML {
+			continue
+		}
+		parsed[name], err = parseTemplate(name)
+		if err != nil {
+			return err
+		}
+	}
+	translations := make(map[string]map[string]string)
+	for _, locale := range locales {
+		translations[locale], err = readLocale(locale)
+		if err != nil {
+			return err
+		}
+	}
+	templateCache = parsed
+	translationCache = translations
+	return nil
+}
+
+// parseTemplate parses a page with base XML, or bag.plist on its own.
+func parseTemplate(name string) (*template.Template, error) {
+	file := strings.TrimPrefix(name, templatesDir)
+	if path.Ext(name) != ".xml" {
+		return template.ParseFS(templateFS, file)
+	}
+	return template.ParseFS(templateFS, strings.TrimPrefix(baseXML, templatesDir), file)
+}
+
+// getTemplate returns parsed template with given name, e.g. templates/main.xml.
+func getTemplate(name string) (*template.Template, error) {
+	if reloadTemplates {
+		return parseTemplate(name)
+	}
+	if template, ok := templateCache[name]; ok {
+		return template, nil
+	}
+	return nil, errors.New("Template could not be found: " + name)
+}
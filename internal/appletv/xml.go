@@ -2,30 +2,38 @@ package appletv
 
 import (
 	"embed"
-	"encoding/json"
+	"net"
 	"net/http"
-	"text/template"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/ghokun/appletv3-iptv/internal/cert"
 	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/dns"
+	"github.com/ghokun/appletv3-iptv/internal/epg"
 	"github.com/ghokun/appletv3-iptv/internal/logging"
 	"github.com/ghokun/appletv3-iptv/internal/m3u"
-	"golang.org/x/text/language"
 )
 
 const (
-	basePath = "https://appletv.redbull.tv"
 	baseXML  = "templates/base.xml"
 	errorXML = "templates/error.xml"
+	bagPlist = "templates/bag.plist"
+	// Default title of application in Apple TV main menu
+	defaultMenuTitle = "IPTV"
+	// guideSlice is the duration of programmes shown in a guide page.
+	guideSlice = 3 * time.Hour
+	// categoryPageSize is the number of channels shown in a category page, Apple TV is sluggish with more.
+	categoryPageSize = 60
+	// guidePageSize is the number of channels shown in a guide page, each with programmes of a time slice.
+	guidePageSize = 20
 )
 
 //go:embed templates
 var templates embed.FS
 
-var matcher = language.NewMatcher([]language.Tag{
-	language.AmericanEnglish,
-	language.Turkish,
-})
-
 // TemplateData struct is evaluated in all pages.
 type TemplateData struct {
 	BasePath     string
@@ -34,7 +42,7 @@ type TemplateData struct {
 	Translations map[string]string
 }
 
-// ErrorData struct is evaluated error pages.
+// ErrorData struct is evaluated error pages. Title is a translation key, or shown as is if it is not.
 type ErrorData struct {
 	Title       string
 	Description string
@@ -43,47 +51,108 @@ type ErrorData struct {
 // SettingsData struct is evaluated in Setting pages.
 type SettingsData struct {
 	Version              string
+	Language             string // Empty if language is detected from Apple TV
+	LanguageName         string
 	M3UPath              string
 	ReloadChannelsActive bool
+	Sources              []SourceData
 	ChannelCount         int
 	RecentCount          int
 	FavoritesCount       int
+	LogoCacheCount       int
 	LogsActive           bool
+	UpdateBlockActive    bool
+	CertificateExpiry    time.Time // Zero if certificate could not be read
+	CertificateExpiring  bool
+}
+
+// SourceData struct is evaluated in Settings page for each playlist source.
+type SourceData struct {
+	config.Source
+	ChannelCount int
+	Default      bool // Source defined by M3U address can not be disabled
+}
+
+// CategoryData struct is evaluated in category page and A–Z index of category.
+// Preview is set when page is shown next to category list, otherwise category page is a full page.
+type CategoryData struct {
+	Category  m3u.Category
+	Channels  []m3u.Channel // Channels in page
+	Preview   bool
+	Page      int
+	PageCount int
+	Previous  int              // Previous page, 0 if page is first
+	Next      int              // Next page, 0 if page is last
+	Letters   []CategoryLetter // Only set if there is more than one page and channels are sorted by name
+}
+
+// CategoryLetter is an entry of A–Z index, first page that has channels starting with letter.
+type CategoryLetter struct {
+	Letter string
+	Page   int
+	Count  int
+}
+
+// ChannelData struct is evaluated in channel detail page.
+type ChannelData struct {
+	Channel m3u.Channel
+	Health  m3u.StreamHealth
+}
+
+// BagData struct is evaluated in bag.plist, which describes application in Apple TV main menu.
+type BagData struct {
+	MenuTitle    string
+	MenuIcon720  string
+	MenuIcon1080 string
+	Merchant     string
+}
+
+// GuideData struct is evaluated in programme guide page.
+// Category is nil when categories are listed. ChannelID is set when guide of a single channel is shown.
+type GuideData struct {
+	Playlist  *m3u.Playlist
+	Category  *m3u.Category
+	ChannelID string
+	Now       time.Time
+	Start     time.Time
+	End       time.Time
+	Earlier   int64 // Start of previous time slice, unix seconds
+	Later     int64 // Start of next time slice, unix seconds
+	Rows      []GuideRow
+	Page      int
+	PageCount int
+	Previous  int // Previous page, 0 if page is first
+	Next      int // Next page, 0 if page is last
+}
+
+// GuideRow is a channel and its programmes in a guide time slice.
+type GuideRow struct {
+	Channel    m3u.Channel
+	Programmes []epg.Programme
 }
 
-// GenerateXML : Parses base XML with given template
+// GenerateXML : Executes base XML with given template
 func GenerateXML(w http.ResponseWriter, r *http.Request, templateName string, data interface{}) {
-	template, err := template.ParseFS(templates, baseXML, templateName)
+	template, err := getTemplate(templateName)
 	if err != nil {
 		logging.Warn(err)
 		GenerateErrorXML(w, r, ErrorData{
-			Title:       "Template Parse Error",
+			Title:       "error.template.parse",
 			Description: err.Error(),
 		})
 		return
 	}
-	accept := r.Header.Get("Accept-Language")
-	tag, _ := language.MatchStrings(matcher, accept)
-	file, err := templates.ReadFile("templates/locales/" + tag.String() + ".json")
+	translations, err := GetTranslations(GetLocale(r))
 	if err != nil {
 		logging.Warn(err)
 		GenerateErrorXML(w, r, ErrorData{
-			Title:       "Translation Load Error",
-			Description: err.Error(),
-		})
-		return
-	}
-	var translations map[string]string
-	if err := json.Unmarshal(file, &translations); err != nil {
-		logging.Warn(err)
-		GenerateErrorXML(w, r, ErrorData{
-			Title:       "Translation Decode Error",
+			Title:       "error.translation",
 			Description: err.Error(),
 		})
 		return
 	}
 	templateData := TemplateData{
-		BasePath:     basePath,
+		BasePath:     GetBasePath(r),
 		BodyID:       templateName,
 		Data:         data,
 		Translations: translations,
@@ -93,41 +162,293 @@ func GenerateXML(w http.ResponseWriter, r *http.Request, templateName string, da
 	if err != nil {
 		logging.Warn(err)
 		GenerateErrorXML(w, r, ErrorData{
-			Title:       "Template Execution Error",
+			Title:       "error.template.execute",
 			Description: err.Error(),
 		})
 		return
 	}
 }
 
-// GenerateErrorXML : If this fails application should stop.
+// GenerateBagPlist : Executes bag.plist with menu title, icons and merchant of app in config
+func GenerateBagPlist(w http.ResponseWriter, r *http.Request) {
+	template, err := getTemplate(bagPlist)
+	if err != nil {
+		logging.Warn(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app := GetApp(r)
+	data := BagData{
+		MenuTitle:    app.MenuTitle,
+		MenuIcon720:  menuIconURL(r, app.MenuIcon720, "/menu-icon-720.png"),
+		MenuIcon1080: menuIconURL(r, app.MenuIcon1080, "/menu-icon-1080.png"),
+		Merchant:     app.Merchant,
+	}
+	if data.MenuTitle == "" {
+		data.MenuTitle = defaultMenuTitle
+	}
+	templateData := TemplateData{
+		BasePath: GetBasePath(r),
+		BodyID:   bagPlist,
+		Data:     data,
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	err = template.Execute(w, templateData)
+	if err != nil {
+		logging.Warn(err)
+	}
+}
+
+// menuIconURL returns icon address if it is a URL, otherwise icon is served by appletv3-iptv from given path.
+func menuIconURL(r *http.Request, icon string, path string) string {
+	if strings.HasPrefix(icon, "http://") || strings.HasPrefix(icon, "https://") {
+		return icon
+	}
+	return GetBasePath(r) + path
+}
+
+// GetApp returns hijacked app that request is sent to, selected by TLS server name or Host header.
+// Forwarded headers are not used, so that a client can not select another app.
+func GetApp(r *http.Request) config.App {
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		return config.Current.GetApp(r.TLS.ServerName)
+	}
+	return config.Current.GetApp(r.Host)
+}
+
+// GetBasePath returns address that links in pages start with. Base path of app in config takes
+// precedence, otherwise it is built from scheme and host of request.
+func GetBasePath(r *http.Request) string {
+	app := GetApp(r)
+	if app.BasePath != "" {
+		return strings.TrimSuffix(app.BasePath, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := strings.ToLower(forwardedValue(r, "X-Forwarded-Proto", "proto")); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	host := r.Host
+	if forwarded := forwardedValue(r, "X-Forwarded-Host", "host"); forwarded != "" {
+		host = forwarded
+	}
+	// Base path is written into JavaScript of pages without escaping
+	if !isValidHost(host) {
+		host = app.Host
+	}
+	return scheme + "://" + host
+}
+
+// isValidHost - Does host consist of host name or IP address characters and an optional port only?
+func isValidHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(".-:[]", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardedValue returns value set by first reverse proxy, from X-Forwarded-* header or Forwarded header.
+// Headers are ignored unless request comes from a trusted proxy in config.
+func forwardedValue(r *http.Request, header string, key string) string {
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteHost = r.RemoteAddr
+	}
+	if !config.Current.IsTrustedProxy(net.ParseIP(remoteHost)) {
+		return ""
+	}
+	if value := r.Header.Get(header); value != "" {
+		return strings.TrimSpace(strings.Split(value, ",")[0])
+	}
+	// Forwarded: for=192.0.2.60;proto=https;host=example.com, for=...
+	forwarded := strings.Split(r.Header.Get("Forwarded"), ",")[0]
+	for _, pair := range strings.Split(forwarded, ";") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], key) {
+			return strings.Trim(parts[1], "\"")
+		}
+	}
+	return ""
+}
+
+// GenerateErrorXML : Executes error page. Errors are only logged, e.g. when Apple TV closes connection.
 func GenerateErrorXML(w http.ResponseWriter, r *http.Request, errorData ErrorData) {
-	template, err := template.ParseFS(templates, errorXML)
+	template, err := getTemplate(errorXML)
 	if err != nil {
-		logging.Fatal(err)
+		logging.Warn(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Error page is shown without translations if they can not be read
+	translations, err := GetTranslations(GetLocale(r))
+	if err != nil {
+		logging.Warn(err)
 	}
 	templateData := TemplateData{
-		BasePath:     basePath,
+		BasePath:     GetBasePath(r),
 		BodyID:       errorXML,
 		Data:         errorData,
-		Translations: nil,
+		Translations: translations,
 	}
 	w.Header().Set("Content-Type", "application/xml")
 	err = template.Execute(w, templateData)
 	if err != nil {
-		logging.Fatal(err)
+		logging.Warn(err)
+	}
+}
+
+// paginate returns page within bounds, page count, and range of items in page. Pages start from 1.
+func paginate(count int, page int, size int) (current int, pageCount int, start int, end int) {
+	pageCount = (count + size - 1) / size
+	if pageCount < 1 {
+		pageCount = 1
+	}
+	current = page
+	if current < 1 {
+		current = 1
+	} else if current > pageCount {
+		current = pageCount
+	}
+	start = (current - 1) * size
+	end = start + size
+	if end > count {
+		end = count
 	}
+	return current, pageCount, start, end
 }
 
-// GetSettingsData provides data to Settings page.
-func GetSettingsData() SettingsData {
+// GetCategoryData provides data to a page of category, pages start from 1.
+func GetCategoryData(category m3u.Category, page int, preview bool) CategoryData {
+	channels := category.GetSortedChannels()
+	data := CategoryData{
+		Category: category,
+		Preview:  preview,
+	}
+	var start, end int
+	data.Page, data.PageCount, start, end = paginate(len(channels), page, categoryPageSize)
+	data.Channels = channels[start:end]
+	if data.Page > 1 {
+		data.Previous = data.Page - 1
+	}
+	if data.Page < data.PageCount {
+		data.Next = data.Page + 1
+	}
+	// Channels of a letter are on consecutive pages only if they are sorted by name
+	if data.PageCount == 1 || config.Current.SortOrder != m3u.SortByName {
+		return data
+	}
+	// Page of a letter is where its first channel is
+	letters := make(map[string]int)
+	for i, channel := range channels {
+		letter := channelLetter(channel.Title)
+		if index, ok := letters[letter]; ok {
+			data.Letters[index].Count++
+			continue
+		}
+		letters[letter] = len(data.Letters)
+		data.Letters = append(data.Letters, CategoryLetter{
+			Letter: letter,
+			Page:   i/categoryPageSize + 1,
+			Count:  1,
+		})
+	}
+	// # comes first as in a phone book
+	sort.Slice(data.Letters, func(i, j int) bool {
+		if data.Letters[i].Letter == "#" || data.Letters[j].Letter == "#" {
+			return data.Letters[j].Letter != "#"
+		}
+		return data.Letters[i].Letter < data.Letters[j].Letter
+	})
+	return data
+}
+
+// channelLetter returns upper cased first letter of title, or # if title does not start with a letter.
+func channelLetter(title string) string {
+	for _, r := range title {
+		if unicode.IsLetter(r) {
+			return string(unicode.ToUpper(r))
+		}
+		return "#"
+	}
+	return "#"
+}
+
+// GetGuideData provides data to programme guide page for given category, time slice and page of channels.
+// If channel is not empty, only programmes of that channel are listed.
+func GetGuideData(playlist *m3u.Playlist, category *m3u.Category, channel string, start time.Time, page int) GuideData {
+	end := start.Add(guideSlice)
+	data := GuideData{
+		Playlist:  playlist,
+		Category:  category,
+		ChannelID: channel,
+		Now:       time.Now(),
+		Start:     start,
+		End:       end,
+		Earlier:   start.Add(-guideSlice).Unix(),
+		Later:     end.Unix(),
+	}
+	if category == nil {
+		return data
+	}
+	var channels []m3u.Channel
+	for _, channel := range category.GetSortedChannels() {
+		if data.ChannelID == "" || channel.ID == data.ChannelID {
+			channels = append(channels, channel)
+		}
+	}
+	var first, last int
+	data.Page, data.PageCount, first, last = paginate(len(channels), page, guidePageSize)
+	if data.Page > 1 {
+		data.Previous = data.Page - 1
+	}
+	if data.Page < data.PageCount {
+		data.Next = data.Page + 1
+	}
+	guide := epg.GetGuide()
+	for _, channel := range channels[first:last] {
+		data.Rows = append(data.Rows, GuideRow{
+			Channel:    channel,
+			Programmes: guide.GetProgrammes(guide.FindChannel(channel.TvgID, channel.TvgName, channel.Title), start, end),
+		})
+	}
+	return data
+}
+
+// GetSettingsData provides data to Settings page of given app.
+func GetSettingsData(app config.App) SettingsData {
+	var sources []SourceData
+	for _, source := range config.Current.GetSources() {
+		sources = append(sources, SourceData{
+			Source:       source,
+			ChannelCount: m3u.GetPlaylist().GetSourceChannelsCount(source.Name),
+			Default:      source.Name == config.DefaultSourceName && source.Path == config.Current.GetM3UPath(),
+		})
+	}
+	certificateExpiry, err := cert.GetExpiry(app)
+	if err != nil {
+		logging.Warn("Certificate expiry could not be checked. " + err.Error())
+	}
 	return SettingsData{
 		Version:              config.Version,
-		M3UPath:              config.Current.M3UPath,
-		ReloadChannelsActive: config.Current.M3UPath != "",
+		Language:             config.Current.GetLanguage(),
+		LanguageName:         getLocaleName(config.Current.GetLanguage()),
+		M3UPath:              config.Current.GetM3UPath(),
+		ReloadChannelsActive: len(sources) > 0,
+		Sources:              sources,
 		ChannelCount:         m3u.GetPlaylist().GetChannelsCount(),
 		RecentCount:          m3u.GetPlaylist().GetRecentChannelsCount(),
 		FavoritesCount:       m3u.GetPlaylist().GetFavoriteChannelsCount(),
+		LogoCacheCount:       m3u.GetLogoCacheCount(),
 		LogsActive:           config.Current.LogToFile,
+		UpdateBlockActive:    dns.IsBlocking(),
+		CertificateExpiry:    certificateExpiry,
+		CertificateExpiring:  cert.IsExpiring(certificateExpiry),
 	}
 }
@@ -0,0 +1,172 @@
+package cert
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/logging"
+)
+
+const (
+	validFor = 20 * 365 * 24 * time.Hour
+	// Expiry is warned about in logs and Settings page when certificate expires sooner than this
+	expiryWarning = 30 * 24 * time.Hour
+)
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// Generate - Creates a private key and a self signed certificate for host of app. Certificate of Red Bull TV
+// also covers hijacked hosts. Key is written to key path, certificate followed by key to pem path and
+// DER encoded certificate to cer path, which is the file that is installed on Apple TV.
+func Generate(app config.App) error {
+	hosts := []string{app.Host}
+	if app.Host == config.DefaultAppHost {
+		hosts = append(hosts, config.Current.HijackHosts...)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Country: []string{"US"}, CommonName: app.Host},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              hosts,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	files := []struct {
+		path     string
+		contents []byte
+		mode     os.FileMode
+	}{
+		{app.KeyPath, keyPEM, 0600},
+		{app.PemPath, append(certPEM, keyPEM...), 0600},
+		{app.CerPath, der, 0644},
+	}
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(file.path), os.ModePerm); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file.path, file.contents, file.mode); err != nil {
+			return err
+		}
+	}
+	logging.Info("Generated certificate for " + app.Host + ", valid until " + template.NotAfter.Format("2006-01-02") +
+		". Install " + app.CerPath + " on Apple TV.")
+	return nil
+}
+
+// GenerateAll - Creates certificates of all apps.
+func GenerateAll() error {
+	for _, app := range config.Current.GetApps() {
+		if err := Generate(app); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureExists - Generates certificate of each app if none of its certificate files exist, for example on
+// first run. Files are never overwritten, if only some of them exist an error is returned.
+func EnsureExists() error {
+	for _, app := range config.Current.GetApps() {
+		paths := []string{app.CerPath, app.PemPath, app.KeyPath}
+		existing := 0
+		for _, path := range paths {
+			if fileExists(path) {
+				existing++
+			}
+		}
+		switch existing {
+		case len(paths):
+		case 0:
+			logging.Info("Certificate files of " + app.Host + " do not exist, generating them")
+			if err := Generate(app); err != nil {
+				return err
+			}
+		default:
+			return errors.New("Some of certificate files of " + app.Host + " are missing, run 'cert generate' to create them again: " +
+				app.CerPath + ", " + app.PemPath + ", " + app.KeyPath)
+		}
+	}
+	return nil
+}
+
+// GetExpiry - Gets expiry time of certificate in pem file of app.
+func GetExpiry(app config.App) (notAfter time.Time, err error) {
+	contents, err := ioutil.ReadFile(app.PemPath)
+	if err != nil {
+		return notAfter, err
+	}
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			return notAfter, errors.New("Certificate could not be found in " + app.PemPath)
+		}
+		if block.Type == "CERTIFICATE" {
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return notAfter, err
+			}
+			return certificate.NotAfter, nil
+		}
+	}
+}
+
+// IsExpiring - Does certificate expire soon, or has it expired?
+func IsExpiring(notAfter time.Time) bool {
+	return time.Until(notAfter) < expiryWarning
+}
+
+// CheckExpiry - Logs a warning for each app whose certificate expires soon or has expired.
+func CheckExpiry() {
+	for _, app := range config.Current.GetApps() {
+		notAfter, err := GetExpiry(app)
+		if err != nil {
+			logging.Warn("Certificate expiry of " + app.Host + " could not be checked. " + err.Error())
+			continue
+		}
+		days := int(time.Until(notAfter).Hours() / 24)
+		switch {
+		case days < 0:
+			logging.Warn("Certificate of " + app.Host + " expired on " + notAfter.Format("2006-01-02") + ". Run 'cert generate' and install new certificate on Apple TV.")
+		case IsExpiring(notAfter):
+			logging.Warn("Certificate of " + app.Host + " expires in " + strconv.Itoa(days) + " days. Run 'cert generate' and install new certificate on Apple TV.")
+		}
+	}
+}
@@ -1,29 +1,92 @@
 package config
 
 import (
+	"errors"
 	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Source is an additional M3U playlist that is merged into channel list.
+type Source struct {
+	Name            string `yaml:"name"`
+	Path            string `yaml:"path"`
+	CategoryPrefix  string `yaml:"categoryPrefix"`
+	RefreshInterval string `yaml:"refreshInterval"`
+	RefreshSchedule string `yaml:"refreshSchedule"`
+	Disabled        bool   `yaml:"disabled"`
+}
+
+// App is an Apple TV application whose host is taken over by appletv3-iptv. Each app has its own
+// certificate and main menu entry, requests are routed to an app by their Host header.
+type App struct {
+	Host         string `yaml:"host"`
+	BasePath     string `yaml:"basePath"`
+	CerPath      string `yaml:"cerPath"`
+	PemPath      string `yaml:"pemPath"`
+	KeyPath      string `yaml:"keyPath"`
+	MenuTitle    string `yaml:"menuTitle"`
+	MenuIcon720  string `yaml:"menuIcon720"`
+	MenuIcon1080 string `yaml:"menuIcon1080"`
+	Merchant     string `yaml:"merchant"`
+}
+
 // Config is the struct for configuration.
 type Config struct {
-	M3UPath     string   `yaml:"m3uPath"`
-	HTTPPort    string   `yaml:"httpPort"`
-	HTTPSPort   string   `yaml:"httpsPort"`
-	CerPath     string   `yaml:"cerPath"`
-	PemPath     string   `yaml:"pemPath"`
-	KeyPath     string   `yaml:"keyPath"`
-	LogToFile   bool     `yaml:"logToFile"`
-	LoggingPath string   `yaml:"loggingPath"`
-	Recents     []string `yaml:"recents,flow"`
-	Favorites   []string `yaml:"favorites,flow"`
+	M3UPath         string   `yaml:"m3uPath"`
+	Sources         []Source `yaml:"sources"`
+	EPGPath         string   `yaml:"epgPath"`
+	RefreshInterval string   `yaml:"refreshInterval"`
+	RefreshSchedule string   `yaml:"refreshSchedule"`
+	HTTPPort        string   `yaml:"httpPort"`
+	HTTPSPort       string   `yaml:"httpsPort"`
+	CerPath         string   `yaml:"cerPath"`
+	PemPath         string   `yaml:"pemPath"`
+	KeyPath         string   `yaml:"keyPath"`
+	BasePath        string   `yaml:"basePath"`
+	TrustedProxies  []string `yaml:"trustedProxies,flow"`
+	MenuTitle       string   `yaml:"menuTitle"`
+	MenuIcon720     string   `yaml:"menuIcon720"`
+	MenuIcon1080    string   `yaml:"menuIcon1080"`
+	LogToFile       bool     `yaml:"logToFile"`
+	LoggingPath     string   `yaml:"loggingPath"`
+	Recents         []string `yaml:"recents,flow"`
+	Favorites       []string `yaml:"favorites,flow"`
+	ProxyAll        bool     `yaml:"proxyAll"`
+	Proxied         []string `yaml:"proxied,flow"`
+	PiconPath       string   `yaml:"piconPath"`
+	LogoCacheSize   int      `yaml:"logoCacheSize"`
+	LogoCacheAge    string   `yaml:"logoCacheAge"`
+	DNSEnabled      bool     `yaml:"dnsEnabled"`
+	DNSPort         string   `yaml:"dnsPort"`
+	DNSAddress      string   `yaml:"dnsAddress"`
+	DNSUpstream     string   `yaml:"dnsUpstream"`
+	HijackHosts     []string `yaml:"hijackHosts,flow"`
+	Apps            []App    `yaml:"apps"`
+	DNSBlocklist    []string `yaml:"dnsBlocklist,flow"`
+	DNSBlockMode    string   `yaml:"dnsBlockMode"`
+	Language        string   `yaml:"language"`
+	SortOrder       string   `yaml:"sortOrder"`
 }
 
+const (
+	// DefaultSourceName is the name of source that is defined by m3uPath.
+	DefaultSourceName = "M3U"
+	// DefaultAppHost is the host of Red Bull TV application, which is defined by top level certificate and menu settings.
+	DefaultAppHost = "appletv.redbull.tv"
+	// DefaultAppMerchant is the merchant identifier of Red Bull TV application.
+	DefaultAppMerchant = "com.redbulltv.appletv.prod"
+)
+
 var (
 	// Current - Global configuration variable.
 	Current           *Config
 	currentConfigFile *string
+	// configMutex is held while fields of config are changed and written to file
+	configMutex sync.Mutex
 	// Version - Set by ldflags
 	Version string
 )
@@ -38,10 +101,17 @@ func LoadConfig(configFile string) (err error) {
 	if err != nil {
 		return err
 	}
+	// Default source would be indistinguishable from a source with the same name in settings
+	for _, source := range Current.Sources {
+		if source.Name == DefaultSourceName {
+			return errors.New("Source name " + DefaultSourceName + " is reserved for m3uPath, please rename source with path " + source.Path)
+		}
+	}
 	currentConfigFile = &configFile
 	return nil
 }
 
+// saveConfig writes config to file, configMutex must be held.
 func saveConfig(config *Config) (err error) {
 	contents, err := yaml.Marshal(&config)
 	if err != nil {
@@ -56,30 +126,154 @@ func saveConfig(config *Config) (err error) {
 
 // SaveM3UPath - Edits M3U path and saves to configuration file.
 func (config *Config) SaveM3UPath(newM3UPath string) (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
 	config.M3UPath = newM3UPath
 	return saveConfig(config)
 }
 
+// GetM3UPath - Gets M3U path, which can be changed from settings.
+func (config *Config) GetM3UPath() string {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return config.M3UPath
+}
+
+// GetLanguage - Gets language of pages, which can be changed from settings. Empty if it is detected from Apple TV.
+func (config *Config) GetLanguage() string {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return config.Language
+}
+
+// SaveLanguage - Edits language of pages and saves to configuration file. Empty language is detected from Apple TV.
+func (config *Config) SaveLanguage(newLanguage string) (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.Language = newLanguage
+	return saveConfig(config)
+}
+
+// GetSources - Gets all playlist sources. M3U path is the first source, if set.
+func (config *Config) GetSources() (sources []Source) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	if config.M3UPath != "" {
+		sources = append(sources, Source{Name: DefaultSourceName, Path: config.M3UPath})
+	}
+	return append(sources, config.Sources...)
+}
+
+// GetApps - Gets all hijacked apps, Red Bull TV first. Missing certificate paths are set to <host>.cer,
+// <host>.pem and <host>.key, or redbulltv.* for Red Bull TV.
+func (config *Config) GetApps() (apps []App) {
+	apps = append(apps, App{
+		Host:         DefaultAppHost,
+		BasePath:     config.BasePath,
+		CerPath:      config.CerPath,
+		PemPath:      config.PemPath,
+		KeyPath:      config.KeyPath,
+		MenuTitle:    config.MenuTitle,
+		MenuIcon720:  config.MenuIcon720,
+		MenuIcon1080: config.MenuIcon1080,
+		Merchant:     DefaultAppMerchant,
+	})
+	apps = append(apps, config.Apps...)
+	for i := range apps {
+		name := apps[i].Host
+		if i == 0 {
+			name = "redbulltv"
+		}
+		if apps[i].CerPath == "" {
+			apps[i].CerPath = name + ".cer"
+		}
+		if apps[i].PemPath == "" {
+			apps[i].PemPath = name + ".pem"
+		}
+		if apps[i].KeyPath == "" {
+			apps[i].KeyPath = name + ".key"
+		}
+	}
+	return apps
+}
+
+// GetApp - Gets app with given host, port is ignored. Red Bull TV is returned if no app matches.
+func (config *Config) GetApp(host string) App {
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	apps := config.GetApps()
+	for _, app := range apps {
+		if strings.EqualFold(app.Host, host) {
+			return app
+		}
+	}
+	return apps[0]
+}
+
+// IsTrustedProxy - Is given address one of trusted reverse proxies? Trusted proxies are IP addresses or CIDR ranges.
+func (config *Config) IsTrustedProxy(address net.IP) bool {
+	for _, proxy := range config.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(address) {
+				return true
+			}
+		} else if net.ParseIP(proxy).Equal(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSourceEnabled - Enables or disables a source and saves to configuration file.
+func (config *Config) SetSourceEnabled(name string, enabled bool) (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	for i := range config.Sources {
+		if config.Sources[i].Name == name {
+			config.Sources[i].Disabled = !enabled
+			return saveConfig(config)
+		}
+	}
+	return errors.New("Source could not be found: " + name)
+}
+
 // SaveRecents - Save recent channels to file, in order to preserve between restarts.
 func (config *Config) SaveRecents(newRecents []string) (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
 	config.Recents = newRecents
 	return saveConfig(config)
 }
 
 // ClearRecents -
 func (config *Config) ClearRecents() (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
 	config.Recents = make([]string, 0)
 	return saveConfig(config)
 }
 
 // SaveFavorites - Save favorite channels to file, in order to preserve between restarts.
 func (config *Config) SaveFavorites(newFavorites []string) (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
 	config.Favorites = newFavorites
 	return saveConfig(config)
 }
 
 // ClearFavorites -
 func (config *Config) ClearFavorites() (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
 	config.Favorites = make([]string, 0)
 	return saveConfig(config)
 }
+
+// SaveProxied - Save channels that are streamed through appletv3-iptv to file.
+func (config *Config) SaveProxied(newProxied []string) (err error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.Proxied = newProxied
+	return saveConfig(config)
+}
@@ -0,0 +1,288 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/logging"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultUpstream = "1.1.1.1:53"
+	defaultPort     = "53"
+	hijackTTL       = 60
+	upstreamTimeout = 5 * time.Second
+	maxPacketSize   = 4096
+	// Blocked hosts are answered with 0.0.0.0 and :: by default, or with NXDOMAIN
+	blockModeNXDomain     = "nxdomain"
+	maxBlockedLookupCount = 100
+)
+
+// Hosts that Apple TV checks and downloads software updates from, blocked unless dnsBlocklist is set.
+var defaultBlocklist = []string{"mesu.apple.com", "appldnld.apple.com", "updates.cdn-apple.com", "updates-http.cdn-apple.com"}
+
+// BlockedLookup is a query for a blocked host.
+type BlockedLookup struct {
+	Time   time.Time
+	Host   string
+	Client string
+}
+
+var (
+	blockedLookups []BlockedLookup // Most recent blocked lookups, newest last
+	blocking       bool            // Is DNS server running with a blocklist?
+	blockedMutex   sync.RWMutex
+)
+
+// Server answers queries for hijacked hosts with address of appletv3-iptv and forwards
+// everything else to upstream DNS server.
+type Server struct {
+	Address  net.IP          // IPv4 address that hijacked hosts resolve to
+	Upstream string          // host:port of upstream DNS server
+	Hosts    map[string]bool // Hijacked host names, lower case without trailing dot
+	Blocked  map[string]bool // Blocked host names, their subdomains are blocked too
+	NXDomain bool            // Answer blocked hosts with NXDOMAIN instead of 0.0.0.0
+}
+
+// Start - Starts DNS server in background if it is enabled in config.
+func Start() error {
+	if !config.Current.DNSEnabled {
+		return nil
+	}
+	address := net.ParseIP(config.Current.DNSAddress)
+	if address == nil {
+		var err error
+		address, err = lanAddress()
+		if err != nil {
+			return err
+		}
+	}
+	upstream := config.Current.DNSUpstream
+	if upstream == "" {
+		upstream = defaultUpstream
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+	port := config.Current.DNSPort
+	if port == "" {
+		port = defaultPort
+	}
+	hosts := append([]string{}, config.Current.HijackHosts...)
+	for _, app := range config.Current.GetApps() {
+		hosts = append(hosts, app.Host)
+	}
+	server := NewServer(address, upstream, hosts)
+	blocklist := config.Current.DNSBlocklist
+	if blocklist == nil {
+		blocklist = defaultBlocklist
+	}
+	for _, host := range blocklist {
+		server.Blocked[normalizeHost(host)] = true
+	}
+	server.NXDomain = strings.EqualFold(config.Current.DNSBlockMode, blockModeNXDomain)
+	conn, err := net.ListenPacket("udp", ":"+port)
+	if err != nil {
+		return err
+	}
+	logging.Info("Starting DNS server on port " + port + ", answering " + strings.Join(hosts, ", ") + " with " + address.String() + ", forwarding to " + upstream)
+	if len(server.Blocked) > 0 {
+		logging.Info("Blocking DNS lookups of " + strings.Join(blocklist, ", "))
+		blockedMutex.Lock()
+		blocking = true
+		blockedMutex.Unlock()
+	}
+	go func() {
+		logging.Warn(server.Serve(conn))
+	}()
+	return nil
+}
+
+// NewServer - Creates a DNS server. Host of Red Bull TV application is always hijacked.
+func NewServer(address net.IP, upstream string, hosts []string) *Server {
+	server := &Server{
+		Address:  address.To4(),
+		Upstream: upstream,
+		Hosts:    map[string]bool{config.DefaultAppHost: true},
+		Blocked:  make(map[string]bool),
+	}
+	for _, host := range hosts {
+		server.Hosts[normalizeHost(host)] = true
+	}
+	return server
+}
+
+// lanAddress returns address of the interface that is used for reaching outside networks.
+// Nothing is sent, UDP dial only selects a route.
+func lanAddress() (net.IP, error) {
+	conn, err := net.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		return nil, errors.New("LAN address could not be detected, set dnsAddress. " + err.Error())
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// IsBlocking - Is DNS server running and blocking hosts?
+func IsBlocking() bool {
+	blockedMutex.RLock()
+	defer blockedMutex.RUnlock()
+	return blocking
+}
+
+// GetBlockedLookups - Gets most recent blocked lookups, newest first.
+func GetBlockedLookups() (lookups []BlockedLookup) {
+	blockedMutex.RLock()
+	defer blockedMutex.RUnlock()
+	for i := len(blockedLookups) - 1; i >= 0; i-- {
+		lookups = append(lookups, blockedLookups[i])
+	}
+	return lookups
+}
+
+func recordBlockedLookup(host string, client net.Addr) {
+	clientHost, _, err := net.SplitHostPort(client.String())
+	if err != nil {
+		clientHost = client.String()
+	}
+	logging.Info("Blocked DNS lookup of " + host + " from " + clientHost)
+	blockedMutex.Lock()
+	defer blockedMutex.Unlock()
+	blockedLookups = append(blockedLookups, BlockedLookup{Time: time.Now(), Host: host, Client: clientHost})
+	if len(blockedLookups) > maxBlockedLookupCount {
+		blockedLookups = blockedLookups[len(blockedLookups)-maxBlockedLookupCount:]
+	}
+}
+
+// isBlocked - Is host or one of its parent domains blocked?
+func (server *Server) isBlocked(host string) bool {
+	for host != "" {
+		if server.Blocked[host] {
+			return true
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+// Serve - Answers queries arriving to conn until it is closed.
+func (server *Server) Serve(conn net.PacketConn) error {
+	if server.Address == nil {
+		return errors.New("DNS server address must be an IPv4 address")
+	}
+	for {
+		buffer := make([]byte, maxPacketSize)
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		go server.handle(conn, addr, buffer[:n])
+	}
+}
+
+func (server *Server) handle(conn net.PacketConn, addr net.Addr, packet []byte) {
+	response, err := server.answer(packet, addr)
+	if err != nil {
+		logging.Warn("Error while answering DNS query from " + addr.String() + ". " + err.Error())
+		return
+	}
+	if response != nil {
+		conn.WriteTo(response, addr)
+	}
+}
+
+// answer returns response of a query packet. Queries that are not hijacked or blocked are forwarded.
+func (server *Server) answer(packet []byte, client net.Addr) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(packet)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	host := normalizeHost(question.Name.String())
+	blocked := server.isBlocked(host)
+	if !blocked && !server.Hosts[host] {
+		return server.forward(packet)
+	}
+	header.Response = true
+	header.Authoritative = true
+	header.RecursionAvailable = true
+	header.RCode = dnsmessage.RCodeSuccess
+	address := server.Address
+	if blocked {
+		recordBlockedLookup(host, client)
+		address = net.IPv4zero.To4()
+		if server.NXDomain {
+			header.RCode = dnsmessage.RCodeNameError
+		}
+	}
+	builder := dnsmessage.NewBuilder(nil, header)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if header.RCode == dnsmessage.RCodeNameError {
+		return builder.Finish()
+	}
+	resourceHeader := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   hijackTTL,
+	}
+	// Other record types get an empty answer, so that clients fall back to IPv4
+	if question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeALL {
+		var a dnsmessage.AResource
+		copy(a.A[:], address)
+		if err := builder.AResource(resourceHeader, a); err != nil {
+			return nil, err
+		}
+	}
+	// Blocked hosts must not be reachable over IPv6 either
+	if blocked && (question.Type == dnsmessage.TypeAAAA || question.Type == dnsmessage.TypeALL) {
+		if err := builder.AAAAResource(resourceHeader, dnsmessage.AAAAResource{}); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+// forward sends query to upstream server and returns its response as it is.
+func (server *Server) forward(packet []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server.Upstream, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, maxPacketSize)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
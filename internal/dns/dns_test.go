@@ -0,0 +1,208 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	hijackAddress   = net.IPv4(192, 168, 1, 10)
+	upstreamAddress = [4]byte{203, 0, 113, 7}
+)
+
+// startUpstream starts a stub upstream DNS server that answers every query with upstreamAddress.
+// Queries it receives and responses it sends are returned through channels.
+func startUpstream(t *testing.T) (address string, queries chan []byte, responses chan []byte) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	queries = make(chan []byte, 1)
+	responses = make(chan []byte, 1)
+	go func() {
+		for {
+			buffer := make([]byte, maxPacketSize)
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var message dnsmessage.Message
+			if err := message.Unpack(buffer[:n]); err != nil {
+				continue
+			}
+			message.Header.Response = true
+			message.Header.RecursionAvailable = true
+			message.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: message.Questions[0].Name, Class: dnsmessage.ClassINET, TTL: 1234},
+				Body:   &dnsmessage.AResource{A: upstreamAddress},
+			}}
+			response, err := message.Pack()
+			if err != nil {
+				continue
+			}
+			queries <- buffer[:n]
+			responses <- response
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), queries, responses
+}
+
+// startServer starts server on a random local port and returns its address.
+func startServer(t *testing.T, server *Server) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go server.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+func newQuery(t *testing.T, id uint16, host string, questionType dnsmessage.Type) []byte {
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(host),
+			Type:  questionType,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+// exchange sends query to server and returns raw response.
+func exchange(t *testing.T, server string, query []byte) []byte {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, maxPacketSize)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer[:n]
+}
+
+func unpack(t *testing.T, response []byte) dnsmessage.Message {
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestHijackedHosts(t *testing.T) {
+	upstream, queries, _ := startUpstream(t)
+	server := startServer(t, NewServer(hijackAddress, upstream, []string{"Example.com."}))
+
+	for _, host := range []string{"appletv.redbull.tv.", "example.com.", "EXAMPLE.com."} {
+		message := unpack(t, exchange(t, server, newQuery(t, 42, host, dnsmessage.TypeA)))
+		if message.Header.ID != 42 || !message.Header.Response || message.Header.RCode != dnsmessage.RCodeSuccess {
+			t.Fatalf("%s: unexpected header %+v", host, message.Header)
+		}
+		if len(message.Answers) != 1 {
+			t.Fatalf("%s: got %d answers, want 1", host, len(message.Answers))
+		}
+		a, ok := message.Answers[0].Body.(*dnsmessage.AResource)
+		if !ok || !net.IP(a.A[:]).Equal(hijackAddress) {
+			t.Errorf("%s: got answer %v, want %v", host, message.Answers[0].Body, hijackAddress)
+		}
+	}
+
+	// IPv6 lookups of hijacked hosts get no answer, so that Apple TV uses IPv4
+	message := unpack(t, exchange(t, server, newQuery(t, 43, "example.com.", dnsmessage.TypeAAAA)))
+	if message.Header.RCode != dnsmessage.RCodeSuccess || len(message.Answers) != 0 {
+		t.Errorf("AAAA: got %v with %d answers, want empty answer", message.Header.RCode, len(message.Answers))
+	}
+	select {
+	case <-queries:
+		t.Error("Hijacked host was forwarded to upstream")
+	default:
+	}
+}
+
+func TestForward(t *testing.T) {
+	upstream, queries, responses := startUpstream(t)
+	server := startServer(t, NewServer(hijackAddress, upstream, []string{"example.com"}))
+
+	for _, host := range []string{"apple.com.", "sub.example.com.", "example.org."} {
+		query := newQuery(t, 7, host, dnsmessage.TypeA)
+		response := exchange(t, server, query)
+		if forwarded := <-queries; !bytes.Equal(forwarded, query) {
+			t.Errorf("%s: upstream got %x, want %x", host, forwarded, query)
+		}
+		if relayed := <-responses; !bytes.Equal(response, relayed) {
+			t.Errorf("%s: got %x, want upstream response %x", host, response, relayed)
+		}
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	tests := []struct {
+		name     string
+		nxdomain bool
+		host     string
+		kind     dnsmessage.Type
+		rcode    dnsmessage.RCode
+		answer   dnsmessage.ResourceBody
+	}{
+		{name: "A", host: "mesu.apple.com.", kind: dnsmessage.TypeA, rcode: dnsmessage.RCodeSuccess, answer: &dnsmessage.AResource{}},
+		{name: "AAAA", host: "mesu.apple.com.", kind: dnsmessage.TypeAAAA, rcode: dnsmessage.RCodeSuccess, answer: &dnsmessage.AAAAResource{}},
+		{name: "subdomain", host: "a.b.Mesu.Apple.com.", kind: dnsmessage.TypeA, rcode: dnsmessage.RCodeSuccess, answer: &dnsmessage.AResource{}},
+		{name: "nxdomain", nxdomain: true, host: "mesu.apple.com.", kind: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError},
+		{name: "nxdomain subdomain", nxdomain: true, host: "x.mesu.apple.com.", kind: dnsmessage.TypeAAAA, rcode: dnsmessage.RCodeNameError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstream, queries, _ := startUpstream(t)
+			dnsServer := NewServer(hijackAddress, upstream, nil)
+			dnsServer.Blocked["mesu.apple.com"] = true
+			dnsServer.NXDomain = test.nxdomain
+			server := startServer(t, dnsServer)
+
+			message := unpack(t, exchange(t, server, newQuery(t, 1, test.host, test.kind)))
+			if message.Header.RCode != test.rcode {
+				t.Fatalf("got %v, want %v", message.Header.RCode, test.rcode)
+			}
+			if test.answer == nil {
+				if len(message.Answers) != 0 {
+					t.Errorf("got %d answers, want none", len(message.Answers))
+				}
+			} else if len(message.Answers) != 1 || message.Answers[0].Body.GoString() != test.answer.GoString() {
+				t.Errorf("got answers %v, want %v", message.Answers, test.answer)
+			}
+			select {
+			case <-queries:
+				t.Error("Blocked host was forwarded to upstream")
+			default:
+			}
+		})
+	}
+
+	// Parent domains of blocked hosts are not blocked
+	upstream, queries, _ := startUpstream(t)
+	dnsServer := NewServer(hijackAddress, upstream, nil)
+	dnsServer.Blocked["mesu.apple.com"] = true
+	server := startServer(t, dnsServer)
+	query := newQuery(t, 2, "apple.com.", dnsmessage.TypeA)
+	exchange(t, server, query)
+	if forwarded := <-queries; !bytes.Equal(forwarded, query) {
+		t.Errorf("apple.com was not forwarded")
+	}
+}
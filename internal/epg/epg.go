@@ -0,0 +1,214 @@
+package epg
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/logging"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+const (
+	xmltvTimeLayout = "20060102150405 -0700"
+	// Times without offset are UTC
+	xmltvUTCTimeLayout = "20060102150405"
+)
+
+var (
+	singleton *Guide
+	mutex     sync.RWMutex
+)
+
+type xmltvChannel struct {
+	ID           string   `xml:"id,attr"`
+	DisplayNames []string `xml:"display-name"`
+}
+
+type xmltvProgramme struct {
+	Channel     string   `xml:"channel,attr"`
+	Start       string   `xml:"start,attr"`
+	Stop        string   `xml:"stop,attr"`
+	Titles      []string `xml:"title"`
+	SubTitles   []string `xml:"sub-title"`
+	Description []string `xml:"desc"`
+	Categories  []string `xml:"category"`
+}
+
+// GenerateGuide loads EPG from epgPath in config file, or from given playlist header
+// value (x-tvg-url or url-tvg) if config is empty. Both may contain comma separated sources.
+func GenerateGuide(playlistEPGPath string) (err error) {
+	paths := config.Current.EPGPath
+	if paths == "" {
+		paths = playlistEPGPath
+	}
+	if paths == "" {
+		return nil
+	}
+	guide := Guide{
+		Channels:   make(map[string]GuideChannel),
+		Programmes: make(map[string][]Programme),
+		names:      make(map[string]string),
+	}
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		logging.Info("Loading EPG from: " + path)
+		if parseErr := guide.parseXMLTV(path); parseErr != nil {
+			logging.Warn("Error while loading EPG from " + path + ". " + parseErr.Error())
+			err = parseErr
+		}
+	}
+	for id := range guide.Programmes {
+		programmes := guide.Programmes[id]
+		sort.SliceStable(programmes, func(i, j int) bool { return programmes[i].Start.Before(programmes[j].Start) })
+		for i := range programmes {
+			if !programmes[i].Stop.IsZero() {
+				continue
+			}
+			if i+1 < len(programmes) {
+				programmes[i].Stop = programmes[i+1].Start
+			} else {
+				programmes[i].Stop = programmes[i].Start.Add(time.Hour)
+			}
+		}
+	}
+	logging.Info("Loaded " + strconv.Itoa(guide.GetProgrammesCount()) + " programmes for " + strconv.Itoa(len(guide.Programmes)) + " channels from EPG")
+	mutex.Lock()
+	singleton = &guide
+	mutex.Unlock()
+	return err
+}
+
+// GetGuide returns singleton, nil if EPG is not loaded.
+func GetGuide() *Guide {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return singleton
+}
+
+func open(fileNameOrURL string) (io.ReadCloser, error) {
+	if strings.HasPrefix(fileNameOrURL, "http://") || strings.HasPrefix(fileNameOrURL, "https://") {
+		response, err := http.Get(fileNameOrURL)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			response.Body.Close()
+			return nil, errors.New("Unable to fetch EPG. Status code: " + response.Status)
+		}
+		return response.Body, nil
+	}
+	return os.Open(fileNameOrURL)
+}
+
+// parseXMLTV adds channels and programmes of an XMLTV file or URL to guide. Gzipped files are supported.
+func (guide *Guide) parseXMLTV(fileNameOrURL string) (err error) {
+	f, err := open(fileNameOrURL)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var reader io.Reader = bufio.NewReader(f)
+	if magic, err := reader.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	decoder := xml.NewDecoder(reader)
+	// XMLTV files are not always utf-8
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		encoding, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return encoding.NewDecoder().Reader(input), nil
+	}
+	skipped := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			if skipped > 0 {
+				logging.Warn("Skipped " + strconv.Itoa(skipped) + " programmes with invalid start time in EPG " + fileNameOrURL)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch element.Name.Local {
+		case "channel":
+			var channel xmltvChannel
+			if err := decoder.DecodeElement(&channel, &element); err != nil {
+				return err
+			}
+			guide.Channels[channel.ID] = GuideChannel{
+				ID:           channel.ID,
+				DisplayNames: channel.DisplayNames,
+			}
+			for _, name := range channel.DisplayNames {
+				if _, ok := guide.names[normalizeName(name)]; !ok {
+					guide.names[normalizeName(name)] = channel.ID
+				}
+			}
+		case "programme":
+			var programme xmltvProgramme
+			if err := decoder.DecodeElement(&programme, &element); err != nil {
+				return err
+			}
+			start, err := parseXMLTVTime(programme.Start)
+			if err != nil {
+				skipped++
+				continue
+			}
+			// stop is optional, it is filled with start of next programme later
+			stop, _ := parseXMLTVTime(programme.Stop)
+			guide.Programmes[programme.Channel] = append(guide.Programmes[programme.Channel], Programme{
+				ChannelID:   programme.Channel,
+				Title:       first(programme.Titles),
+				SubTitle:    first(programme.SubTitles),
+				Description: first(programme.Description),
+				Category:    first(programme.Categories),
+				Start:       start,
+				Stop:        stop,
+			})
+		}
+	}
+}
+
+// parseXMLTVTime parses a start or stop time, e.g. 20210102150405 +0300. Times without offset are UTC.
+func parseXMLTVTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if parsed, err := time.Parse(xmltvTimeLayout, value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse(xmltvUTCTimeLayout, value)
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
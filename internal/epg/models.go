@@ -0,0 +1,112 @@
+package epg
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Guide is an electronic programme guide built from one or more XMLTV sources.
+type Guide struct {
+	Channels   map[string]GuideChannel // XMLTV channel id to channel
+	Programmes map[string][]Programme  // XMLTV channel id to programmes, sorted by start time
+	names      map[string]string       // Normalized display name to XMLTV channel id
+}
+
+// GuideChannel is a <channel> element of an XMLTV file.
+type GuideChannel struct {
+	ID           string
+	DisplayNames []string
+}
+
+// Programme is a <programme> element of an XMLTV file.
+type Programme struct {
+	ChannelID   string
+	Title       string
+	SubTitle    string
+	Description string
+	Category    string
+	Start       time.Time
+	Stop        time.Time
+}
+
+// TimeRange - Formats start and stop times of programme in local time, e.g. 19:00 - 20:00
+func (programme *Programme) TimeRange() string {
+	return programme.Start.Local().Format("15:04") + " - " + programme.Stop.Local().Format("15:04")
+}
+
+// IsLive - Is programme on air at given time?
+func (programme *Programme) IsLive(t time.Time) bool {
+	return !t.Before(programme.Start) && t.Before(programme.Stop)
+}
+
+func normalizeName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// FindChannel - Matches a playlist channel to XMLTV channel id. tvg-id is tried first,
+// then tvg-name and channel title are compared with display names. Returns empty string if no match.
+func (guide *Guide) FindChannel(tvgID string, tvgName string, title string) string {
+	if guide == nil {
+		return ""
+	}
+	if _, ok := guide.Programmes[tvgID]; ok && tvgID != "" {
+		return tvgID
+	}
+	for _, name := range []string{tvgName, title} {
+		if id, ok := guide.names[normalizeName(name)]; ok && name != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// GetProgrammes - Gets programmes of channel that overlap with given time interval.
+func (guide *Guide) GetProgrammes(channelID string, from time.Time, to time.Time) (programmes []Programme) {
+	if guide == nil {
+		return nil
+	}
+	all := guide.Programmes[channelID]
+	i := sort.Search(len(all), func(i int) bool { return all[i].Stop.After(from) })
+	for ; i < len(all) && all[i].Start.Before(to); i++ {
+		programmes = append(programmes, all[i])
+	}
+	return programmes
+}
+
+// GetProgrammeAt - Gets programme on air at given time, nil if there is none.
+func (guide *Guide) GetProgrammeAt(channelID string, t time.Time) *Programme {
+	if guide == nil {
+		return nil
+	}
+	all := guide.Programmes[channelID]
+	i := sort.Search(len(all), func(i int) bool { return all[i].Stop.After(t) })
+	if i < len(all) && all[i].IsLive(t) {
+		return &all[i]
+	}
+	return nil
+}
+
+// GetNextProgramme - Gets first programme that starts after given time, nil if there is none.
+func (guide *Guide) GetNextProgramme(channelID string, t time.Time) *Programme {
+	if guide == nil {
+		return nil
+	}
+	all := guide.Programmes[channelID]
+	i := sort.Search(len(all), func(i int) bool { return all[i].Start.After(t) })
+	if i < len(all) {
+		return &all[i]
+	}
+	return nil
+}
+
+// GetProgrammesCount - Gets count of all programmes in guide.
+func (guide *Guide) GetProgrammesCount() (count int) {
+	if guide == nil {
+		return 0
+	}
+	for _, programmes := range guide.Programmes {
+		count += len(programmes)
+	}
+	return count
+}
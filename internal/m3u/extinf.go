@@ -0,0 +1,105 @@
+package m3u
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// extinf is a tokenized #EXTINF line.
+// #EXTINF:<duration> [key="value" ...],<title>
+type extinf struct {
+	Duration   float64
+	Attributes map[string]string
+	Title      string
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// parseEXTINF tokenizes an #EXTINF line. Attribute values may be double quoted, single quoted or
+// unquoted, and may contain commas, equal signs or spaces when quoted. Title is everything after
+// the first comma that is not inside a quoted value. Attribute keys are lower cased.
+func parseEXTINF(line string) (info extinf, err error) {
+	line = strings.TrimPrefix(line, "#EXTINF:")
+	i := 0
+	for i < len(line) && isSpace(line[i]) {
+		i++
+	}
+	start := i
+	for i < len(line) && !isSpace(line[i]) && line[i] != ',' {
+		i++
+	}
+	// Missing or invalid durations are common in the wild, they are treated as live streams
+	info.Duration, err = strconv.ParseFloat(line[start:i], 64)
+	if err != nil {
+		info.Duration = -1
+		// Duration is missing, token is the first attribute
+		if strings.Contains(line[start:i], "=") {
+			i = start
+		}
+	}
+	attributes, rest, found := parseAttributeList(line[i:])
+	info.Attributes = attributes
+	if found {
+		info.Title = strings.TrimSpace(rest)
+	}
+	if info.Title == "" {
+		info.Title = attributes["tvg-name"]
+	}
+	if info.Title == "" {
+		return info, errors.New("Invalid m3u file format. Expected EXTINF metadata to contain channel name")
+	}
+	return info, nil
+}
+
+// parseAttributeList reads key=value pairs until the first unquoted comma. Returns text after
+// that comma, and whether a comma was found at all. Words without a value are ignored.
+func parseAttributeList(text string) (attributes map[string]string, rest string, found bool) {
+	attributes = make(map[string]string)
+	i := 0
+	for i < len(text) {
+		for i < len(text) && isSpace(text[i]) {
+			i++
+		}
+		if i == len(text) {
+			break
+		}
+		if text[i] == ',' {
+			return attributes, text[i+1:], true
+		}
+		start := i
+		for i < len(text) && text[i] != '=' && text[i] != ',' && !isSpace(text[i]) {
+			i++
+		}
+		key := strings.ToLower(text[start:i])
+		if i == len(text) || text[i] != '=' {
+			continue
+		}
+		i++ // Skip =
+		var value string
+		if i < len(text) && (text[i] == '"' || text[i] == '\'') {
+			quote := text[i]
+			i++
+			start = i
+			for i < len(text) && text[i] != quote {
+				i++
+			}
+			value = text[start:i]
+			if i < len(text) {
+				i++ // Skip closing quote
+			}
+		} else {
+			start = i
+			for i < len(text) && text[i] != ',' && !isSpace(text[i]) {
+				i++
+			}
+			value = text[start:i]
+		}
+		if key != "" {
+			attributes[key] = value
+		}
+	}
+	return attributes, "", false
+}
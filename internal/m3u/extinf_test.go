@@ -0,0 +1,192 @@
+package m3u
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestParseEXTINF(t *testing.T) {
+	tests := []struct {
+		name       string
+		line       string
+		duration   float64
+		attributes map[string]string
+		title      string
+		wantErr    bool
+	}{
+		{
+			name:       "duration and title",
+			line:       "#EXTINF:-1,News",
+			duration:   -1,
+			attributes: map[string]string{},
+			title:      "News",
+		},
+		{
+			name:       "positive duration",
+			line:       "#EXTINF:10.5 tvg-id=\"a\",Movie",
+			duration:   10.5,
+			attributes: map[string]string{"tvg-id": "a"},
+			title:      "Movie",
+		},
+		{
+			name:       "missing duration",
+			line:       "#EXTINF:tvg-id=\"a\" group-title=\"News\",News",
+			duration:   -1,
+			attributes: map[string]string{"tvg-id": "a", "group-title": "News"},
+			title:      "News",
+		},
+		{
+			name:       "quoted and unquoted attributes",
+			line:       "#EXTINF:-1 tvg-id=\"a b\" tvg-chno=5 group-title='Sports',Sports",
+			duration:   -1,
+			attributes: map[string]string{"tvg-id": "a b", "tvg-chno": "5", "group-title": "Sports"},
+			title:      "Sports",
+		},
+		{
+			name:       "upper case keys",
+			line:       "#EXTINF:-1 TVG-ID=\"a\",A",
+			duration:   -1,
+			attributes: map[string]string{"tvg-id": "a"},
+			title:      "A",
+		},
+		{
+			name:       "comma inside quotes",
+			line:       "#EXTINF:-1 group-title=\"News, Weather\" tvg-name=\"a=b\",Weather",
+			duration:   -1,
+			attributes: map[string]string{"group-title": "News, Weather", "tvg-name": "a=b"},
+			title:      "Weather",
+		},
+		{
+			name:       "comma in title",
+			line:       "#EXTINF:-1 tvg-id=\"a\",News, Weather",
+			duration:   -1,
+			attributes: map[string]string{"tvg-id": "a"},
+			title:      "News, Weather",
+		},
+		{
+			name:       "trailing title whitespace",
+			line:       "#EXTINF:-1 tvg-id=\"a\",  News \r",
+			duration:   -1,
+			attributes: map[string]string{"tvg-id": "a"},
+			title:      "News",
+		},
+		{
+			name:       "missing comma uses tvg-name",
+			line:       "#EXTINF:-1 tvg-id=\"a\" tvg-name=\"News\"",
+			duration:   -1,
+			attributes: map[string]string{"tvg-id": "a", "tvg-name": "News"},
+			title:      "News",
+		},
+		{
+			name:    "missing comma without tvg-name",
+			line:    "#EXTINF:-1 tvg-id=\"a\" News",
+			wantErr: true,
+		},
+		{
+			name:    "empty title",
+			line:    "#EXTINF:-1 tvg-id=\"a\",",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated quote",
+			line:    "#EXTINF:-1 group-title=\"News,News",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := parseEXTINF(test.line)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseEXTINF(%q) error = %v, wantErr %v", test.line, err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if info.Duration != test.duration {
+				t.Errorf("Duration = %v, want %v", info.Duration, test.duration)
+			}
+			if !reflect.DeepEqual(info.Attributes, test.attributes) {
+				t.Errorf("Attributes = %v, want %v", info.Attributes, test.attributes)
+			}
+			if info.Title != test.title {
+				t.Errorf("Title = %q, want %q", info.Title, test.title)
+			}
+		})
+	}
+}
+
+func TestParseEXTINFDoesNotPanic(t *testing.T) {
+	parse := func(line string) bool {
+		parseEXTINF("#EXTINF:" + line)
+		parseEXTINF(line)
+		return true
+	}
+	if err := quick.Check(parse, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// randomString returns a string of given characters, which may be empty.
+func randomString(random *rand.Rand, characters string, maxLength int) string {
+	var builder strings.Builder
+	for i := random.Intn(maxLength + 1); i > 0; i-- {
+		builder.WriteByte(characters[random.Intn(len(characters))])
+	}
+	return builder.String()
+}
+
+// formatEXTINF writes a parsed #EXTINF line back, attributes are double quoted.
+func formatEXTINF(info extinf) string {
+	var builder strings.Builder
+	builder.WriteString("#EXTINF:" + strconv.FormatFloat(info.Duration, 'f', -1, 64))
+	for key, value := range info.Attributes {
+		builder.WriteString(" " + key + "=\"" + value + "\"")
+	}
+	builder.WriteString("," + info.Title)
+	return builder.String()
+}
+
+func TestParseEXTINFRoundTrip(t *testing.T) {
+	const (
+		keyCharacters   = "abcdefghijklmnopqrstuvwxyz0123456789-"
+		valueCharacters = "abcXYZ019 ,=-_./:'"
+	)
+	random := rand.New(rand.NewSource(1))
+	for n := 0; n < 1000; n++ {
+		attributes := make(map[string]string)
+		var builder strings.Builder
+		builder.WriteString("#EXTINF:-1")
+		for i := random.Intn(6); i > 0; i-- {
+			key := "k" + randomString(random, keyCharacters, 10)
+			value := randomString(random, valueCharacters, 20)
+			if _, ok := attributes[key]; ok {
+				continue
+			}
+			attributes[key] = value
+			builder.WriteString(" " + key + "=\"" + value + "\"")
+		}
+		title := "t" + randomString(random, valueCharacters, 20)
+		builder.WriteString("," + title)
+		line := builder.String()
+
+		info, err := parseEXTINF(line)
+		if err != nil {
+			t.Fatalf("parseEXTINF(%q) error = %v", line, err)
+		}
+		if !reflect.DeepEqual(info.Attributes, attributes) {
+			t.Fatalf("parseEXTINF(%q) Attributes = %v, want %v", line, info.Attributes, attributes)
+		}
+		if info.Title != strings.TrimSpace(title) {
+			t.Fatalf("parseEXTINF(%q) Title = %q, want %q", line, info.Title, title)
+		}
+		// Writing parsed line back and parsing it again gives same result
+		again, err := parseEXTINF(formatEXTINF(info))
+		if err != nil || !reflect.DeepEqual(again, info) {
+			t.Fatalf("parseEXTINF(%q) is not stable, %v != %v", line, again, info)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package m3u
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Stream health is probed when channel details are shown, it should not keep Apple TV waiting for long.
+const probeTimeout = 3 * time.Second
+
+// StreamHealth is the result of probing media URL of a channel.
+type StreamHealth struct {
+	Reachable   bool          // Media URL responded with a 2xx status
+	StatusCode  int           // Zero if request failed
+	ContentType string        // Content-Type header of response
+	Latency     time.Duration // Time until response headers are received
+	Error       string        // Request error, if any
+}
+
+// ProbeStream - Requests media URL of channel with its HTTP headers and reads the first bytes of response.
+// Probe is cancelled when ctx is done, e.g. when Apple TV closes the request of the page.
+func (channel Channel) ProbeStream(ctx context.Context) (health StreamHealth) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", channel.MediaURL, nil)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	request.Header = channel.GetHTTPHeaders()
+	request.Header.Set("Range", "bytes=0-1023")
+	start := time.Now()
+	response, err := http.DefaultClient.Do(request)
+	health.Latency = time.Since(start)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	defer response.Body.Close()
+	io.CopyN(ioutil.Discard, response.Body, 1024)
+	health.StatusCode = response.StatusCode
+	health.ContentType = response.Header.Get("Content-Type")
+	health.Reachable = response.StatusCode >= 200 && response.StatusCode < 300
+	return health
+}
@@ -1,24 +1,76 @@
 package m3u
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"image"
-	"image/jpeg"
+	"image/draw"
+	_ "image/gif" // Decoders for common logo formats
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/logging"
 	"github.com/nfnt/resize"
 )
 
 const (
 	cacheFolder = ".cache/logo"
 	missing     = "/assets/images/missing_logo.png"
+
+	logoWorkers     = 4               // Count of logos fetched at the same time
+	logoBatchSize   = 100             // Fetched logos are applied to playlist in batches
+	logoBatchDelay  = time.Second     // or at least this often
+	logoMaxAttempts = 5               // Failed logos are retried until then
+	logoRetryDelay  = 1 * time.Minute // Doubled after every failed attempt
+
+	defaultLogoCacheSize = 100                 // Megabytes, used if logoCacheSize is not set
+	defaultLogoCacheAge  = 30 * 24 * time.Hour // Used if logoCacheAge is not set
 )
 
-func missingResponse(err error) (string, error) {
-	return missing, err
+// logoVariant is a logo size for src720 or src1080 attribute of images.
+type logoVariant struct {
+	suffix string
+	width  uint
+	height uint
+}
+
+var logoVariants = []logoVariant{
+	{suffix: "-720.png", width: 320, height: 180},
+	{suffix: "-1080.png", width: 480, height: 270},
 }
 
+type logoJob struct {
+	url     string
+	attempt int
+}
+
+type logoResult struct {
+	url    string
+	logo   string
+	logoHD string
+}
+
+var (
+	logoClient    = &http.Client{Timeout: 30 * time.Second}
+	logoJobs      = make(chan logoJob, logoBatchSize)
+	logoResults   = make(chan logoResult, logoBatchSize)
+	logoPending   = make(map[string]bool) // Logos that are queued, being fetched or waiting for retry
+	logoMutex     sync.Mutex
+	logoStartOnce sync.Once
+)
+
 func fileExists(filename string) bool {
 	fileInfo, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -27,47 +79,369 @@ func fileExists(filename string) bool {
 	return !fileInfo.IsDir()
 }
 
-func computeChannelLogo(id string, rawLogo string) (logo string, err error) {
+// logoID returns cache file name of a logo address. Channels with the same logo share cache file.
+func logoID(rawLogo string) string {
+	hash := sha256.Sum256([]byte(rawLogo))
+	return hex.EncodeToString(hash[:8])
+}
 
-	err = os.MkdirAll(cacheFolder, os.ModePerm)
+// cachedLogo returns addresses of cached 720p and 1080p logos if they exist, missing logo otherwise.
+// Does not fetch anything, logos that are not cached are fetched by queueLogos.
+func cachedLogo(rawLogo string) (logo string, logoHD string) {
+	if rawLogo == "" {
+		return missing, missing
+	}
+	id := logoID(rawLogo)
+	for _, variant := range logoVariants {
+		if !fileExists(cacheFolder + "/" + id + variant.suffix) {
+			return missing, missing
+		}
+	}
+	return "/logo/" + id + logoVariants[0].suffix, "/logo/" + id + logoVariants[1].suffix
+}
+
+// resolveLogos sets logos of channels to cached logos.
+func resolveLogos(playlist *Playlist) {
+	for _, category := range playlist.Categories {
+		for id, channel := range category.Channels {
+			channel.Logo, channel.LogoHD = cachedLogo(logoKey(channel))
+			category.Channels[id] = channel
+		}
+	}
+}
+
+// letterbox resizes image to fit in given size without changing its aspect ratio. Remaining area is transparent.
+func letterbox(source image.Image, width uint, height uint) image.Image {
+	bounds := source.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	}
+	scaledWidth, scaledHeight := width, uint(bounds.Dy())*width/uint(bounds.Dx())
+	if scaledHeight > height {
+		scaledWidth, scaledHeight = uint(bounds.Dx())*height/uint(bounds.Dy()), height
+	}
+	resized := resize.Resize(scaledWidth, scaledHeight, source, resize.Lanczos3)
+	canvas := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	offset := image.Pt((int(width)-resized.Bounds().Dx())/2, (int(height)-resized.Bounds().Dy())/2)
+	draw.Draw(canvas, resized.Bounds().Add(offset), resized, resized.Bounds().Min, draw.Over)
+	return canvas
+}
+
+// writePNG writes to a temporary file first, so that a half written logo is never served.
+func writePNG(filename string, source image.Image) (err error) {
+	file, err := os.Create(filename + ".tmp")
 	if err != nil {
-		return missingResponse(err)
+		return err
 	}
+	err = png.Encode(file, source)
+	file.Close()
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+	}
+	return err
+}
 
+// computeChannelLogo fetches, reads from picon directory or generates logo and caches 720p and 1080p variants of it as PNG files.
+func computeChannelLogo(rawLogo string) (logo string, logoHD string, err error) {
 	if rawLogo == "" {
-		return missingResponse(nil)
+		return missing, missing, nil
+	}
+	if logo, logoHD = cachedLogo(rawLogo); logo != missing {
+		return logo, logoHD, nil
+	}
+	err = os.MkdirAll(cacheFolder, os.ModePerm)
+	if err != nil {
+		return missing, missing, err
+	}
+	id := logoID(rawLogo)
+	if strings.HasPrefix(rawLogo, placeholderPrefix) {
+		for _, variant := range logoVariants {
+			placeholder, err := renderPlaceholder(strings.TrimPrefix(rawLogo, placeholderPrefix), variant.width, variant.height)
+			if err == nil {
+				err = writePNG(cacheFolder+"/"+id+variant.suffix, placeholder)
+			}
+			if err != nil {
+				return missing, missing, err
+			}
+		}
+		logo, logoHD = cachedLogo(rawLogo)
+		return logo, logoHD, nil
+	}
+
+	var reader io.Reader
+	if strings.HasPrefix(rawLogo, piconPrefix) {
+		file, err := os.Open(strings.TrimPrefix(rawLogo, piconPrefix))
+		if err != nil {
+			return missing, missing, err
+		}
+		defer file.Close()
+		reader = file
+	} else {
+		response, err := logoClient.Get(rawLogo)
+		if err != nil {
+			return missing, missing, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			return missing, missing, errors.New("Error while fetching channel logo. Status code: " + response.Status)
+		}
+		reader = response.Body
+	}
+	source, _, err := image.Decode(reader)
+	if err != nil {
+		return missing, missing, err
+	}
+	for _, variant := range logoVariants {
+		err = writePNG(cacheFolder+"/"+id+variant.suffix, letterbox(source, variant.width, variant.height))
+		if err != nil {
+			return missing, missing, err
+		}
+	}
+	logo, logoHD = cachedLogo(rawLogo)
+	return logo, logoHD, nil
+}
+
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// cachedLogoFiles are cache files of a logo, one for each variant. They are removed together.
+type cachedLogoFiles struct {
+	files   []cachedFile
+	size    int64
+	modTime time.Time // Of the newest file
+}
+
+func listLogoCache() (files []cachedFile) {
+	infos, err := ioutil.ReadDir(cacheFolder)
+	if err != nil {
+		return nil
+	}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".png") {
+			files = append(files, cachedFile{
+				path:    filepath.Join(cacheFolder, info.Name()),
+				size:    info.Size(),
+				modTime: info.ModTime(),
+			})
+		}
 	}
+	return files
+}
 
-	logoFilename := cacheFolder + "/" + id + ".png"
-	logo = "/logo/" + id + ".png"
+// listCachedLogos groups cache files by logo identifier.
+func listCachedLogos() map[string]*cachedLogoFiles {
+	logos := make(map[string]*cachedLogoFiles)
+	for _, file := range listLogoCache() {
+		id := filepath.Base(file.path)
+		for _, variant := range logoVariants {
+			id = strings.TrimSuffix(id, variant.suffix)
+		}
+		logo, ok := logos[id]
+		if !ok {
+			logo = &cachedLogoFiles{}
+			logos[id] = logo
+		}
+		logo.files = append(logo.files, file)
+		logo.size += file.size
+		if file.modTime.After(logo.modTime) {
+			logo.modTime = file.modTime
+		}
+	}
+	return logos
+}
 
-	if fileExists(logoFilename) {
-		return logo, nil
+// evictLogoCache removes logos that are older than logoCacheAge, then oldest logos until
+// cache is smaller than logoCacheSize megabytes. Logos of current playlist are kept, so cache may
+// stay larger than logoCacheSize. sourcesMutex must be held, so that playlist is not replaced meanwhile.
+func evictLogoCache() {
+	maxSize := int64(defaultLogoCacheSize)
+	if config.Current.LogoCacheSize > 0 {
+		maxSize = int64(config.Current.LogoCacheSize)
 	}
+	maxSize *= 1024 * 1024
+	maxAge := defaultLogoCacheAge
+	if config.Current.LogoCacheAge != "" {
+		if age, err := time.ParseDuration(config.Current.LogoCacheAge); err == nil {
+			maxAge = age
+		} else {
+			logging.Warn("Invalid logo cache age, using default. " + err.Error())
+		}
+	}
+	used := make(map[string]bool)
+	for _, category := range GetPlaylist().getCategories() {
+		for _, channel := range category.Channels {
+			used[logoID(logoKey(channel))] = true
+		}
+	}
+	var logos []*cachedLogoFiles
+	var total int64
+	for id, logo := range listCachedLogos() {
+		total += logo.size
+		if !used[id] {
+			logos = append(logos, logo)
+		}
+	}
+	sort.Slice(logos, func(i, j int) bool { return logos[i].modTime.Before(logos[j].modTime) })
+	removed := 0
+	for _, logo := range logos {
+		if total <= maxSize && time.Since(logo.modTime) <= maxAge {
+			continue
+		}
+		for _, file := range logo.files {
+			if os.Remove(file.path) == nil {
+				total -= file.size
+			}
+		}
+		removed++
+	}
+	if removed > 0 {
+		logging.Info("Removed " + strconv.Itoa(removed) + " logos from logo cache")
+	}
+}
+
+// GetLogoCacheCount - Gets count of cached logos.
+func GetLogoCacheCount() int {
+	return len(listCachedLogos())
+}
 
-	response, err := http.Get(rawLogo)
+// ClearLogoCache - Removes all cached logos. Logos of current playlist are fetched again.
+func ClearLogoCache() error {
+	for _, file := range listLogoCache() {
+		// File may be removed meanwhile by eviction or another clear
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// Logos are resolved before taking the lock of store, checking files of every channel is slow
+	logos := make(map[string]logoResult)
+	for _, category := range GetPlaylist().getCategories() {
+		for _, channel := range category.Channels {
+			rawLogo := logoKey(channel)
+			if _, ok := logos[rawLogo]; !ok {
+				logo, logoHD := cachedLogo(rawLogo)
+				logos[rawLogo] = logoResult{url: rawLogo, logo: logo, logoHD: logoHD}
+			}
+		}
+	}
+	err := store.Update(func(playlist *Playlist) error {
+		setLogos(playlist, logos)
+		return nil
+	})
 	if err != nil {
-		return missingResponse(err)
+		return err
 	}
+	queueLogos(GetPlaylist())
+	return nil
+}
 
-	defer response.Body.Close()
+// queueLogos fetches logos of channels that are not cached yet in background. Channels show
+// missing logo until their logo is fetched, then playlist is updated.
+func queueLogos(playlist *Playlist) {
+	logoStartOnce.Do(func() {
+		for i := 0; i < logoWorkers; i++ {
+			go logoWorker()
+		}
+		go logoCollector()
+	})
+	var jobs []logoJob
+	logoMutex.Lock()
+	for _, category := range playlist.getCategories() {
+		for _, channel := range category.Channels {
+			rawLogo := logoKey(channel)
+			if channel.Logo == missing && !logoPending[rawLogo] {
+				logoPending[rawLogo] = true
+				jobs = append(jobs, logoJob{url: rawLogo})
+			}
+		}
+	}
+	logoMutex.Unlock()
+	if len(jobs) == 0 {
+		return
+	}
+	logging.Info("Fetching " + strconv.Itoa(len(jobs)) + " channel logos in background")
+	go func() {
+		for _, job := range jobs {
+			logoJobs <- job
+		}
+	}()
+}
 
-	if response.StatusCode >= 200 && response.StatusCode < 300 {
-		image, _, err := image.Decode(response.Body)
-		if err != nil {
-			return missingResponse(err)
+func logoWorker() {
+	for job := range logoJobs {
+		logo, logoHD, err := computeChannelLogo(job.url)
+		if err == nil {
+			logoResults <- logoResult{url: job.url, logo: logo, logoHD: logoHD}
+			continue
+		}
+		job.attempt++
+		if job.attempt >= logoMaxAttempts {
+			logging.Warn("Giving up fetching channel logo " + job.url + ". " + err.Error())
+			logoMutex.Lock()
+			delete(logoPending, job.url)
+			logoMutex.Unlock()
+			continue
 		}
-		resizedImage := resize.Resize(320, 180, image, resize.Lanczos3)
+		retryJob := job
+		time.AfterFunc(logoRetryDelay<<(job.attempt-1), func() {
+			logoJobs <- retryJob
+		})
+	}
+}
 
-		file, err := os.Create(logoFilename)
-		if err != nil {
-			return missingResponse(err)
+// logoCollector applies fetched logos to current playlist. Applying each logo separately would
+// copy the playlist for every channel, so they are collected and applied together.
+func logoCollector() {
+	ticker := time.NewTicker(logoBatchDelay)
+	batch := make(map[string]logoResult)
+	for {
+		select {
+		case result := <-logoResults:
+			batch[result.url] = result
+			if len(batch) < logoBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
 		}
-		err = jpeg.Encode(file, resizedImage, nil)
-		if err != nil {
-			return missingResponse(err)
+		applyLogos(batch)
+		batch = make(map[string]logoResult)
+		sourcesMutex.Lock()
+		evictLogoCache()
+		sourcesMutex.Unlock()
+	}
+}
+
+// setLogos sets logos of channels whose logo is in logos.
+func setLogos(playlist *Playlist, logos map[string]logoResult) {
+	for _, category := range playlist.Categories {
+		for id, channel := range category.Channels {
+			if result, ok := logos[logoKey(channel)]; ok {
+				channel.Logo, channel.LogoHD = result.logo, result.logoHD
+				category.Channels[id] = channel
+			}
 		}
-		return logo, nil
 	}
-	return missingResponse(errors.New("Error while fetching channel logo. Status code: " + response.Status))
+}
+
+func applyLogos(logos map[string]logoResult) {
+	err := store.Update(func(playlist *Playlist) error {
+		setLogos(playlist, logos)
+		return nil
+	})
+	if err != nil {
+		logging.Warn("Error while updating channel logos. " + err.Error())
+	}
+	logoMutex.Lock()
+	for url := range logos {
+		delete(logoPending, url)
+	}
+	logoMutex.Unlock()
 }
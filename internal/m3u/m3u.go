@@ -2,12 +2,13 @@ package m3u
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io"
 	"net/http"
 	"os"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -16,61 +17,138 @@ import (
 	"github.com/google/uuid"
 )
 
-var (
-	singleton *Playlist
-)
+// diff returns channels that exist only in playlist and channels that exist only in previous.
+func (playlist *Playlist) diff(previous *Playlist) (added []Channel, removed []Channel) {
+	for _, category := range playlist.getCategories() {
+		for _, channel := range category.Channels {
+			if _, err := previous.GetChannel(channel.CategoryID, channel.ID); err != nil {
+				added = append(added, channel)
+			}
+		}
+	}
+	for _, category := range previous.getCategories() {
+		for _, channel := range category.Channels {
+			if _, err := playlist.GetChannel(channel.CategoryID, channel.ID); err != nil {
+				removed = append(removed, channel)
+			}
+		}
+	}
+	return added, removed
+}
 
-// GeneratePlaylist takes an m3u playlist and creates Playlists.
-// Loads recent and favorite channels from config file if exist.
-func GeneratePlaylist() (err error) {
-	playlist, err := ParseM3U(config.Current.M3UPath)
-	if err != nil {
-		return err
+func summarizeTitles(channels []Channel) string {
+	const limit = 50
+	var titles []string
+	for i, channel := range channels {
+		if i == limit {
+			titles = append(titles, "and "+strconv.Itoa(len(channels)-limit)+" more")
+			break
+		}
+		titles = append(titles, channel.Category+"/"+channel.Title)
 	}
+	return strings.Join(titles, ", ")
+}
+
+// loadRecentsAndFavorites marks recent, favorite and proxied channels saved in config file.
+func (playlist *Playlist) loadRecentsAndFavorites() {
+	migrated := false
+	var recentChannels []Channel
 	for _, recent := range config.Current.Recents {
 		parts := strings.Split(recent, ":")
+		if len(parts) < 3 {
+			continue
+		}
 		categoryID := parts[0]
 		channelID := parts[1]
 		ordinal := parts[2]
-		channel, err := playlist.GetChannel(categoryID, channelID)
+		channel, err := playlist.getOrMigrateChannel(categoryID, channelID, &migrated)
 		if err != nil {
 			logging.Warn(err)
 		} else {
 			channel.IsRecent = true
 			channel.RecentOrdinal, _ = strconv.Atoi(ordinal)
-			playlist.Categories[categoryID].Channels[channelID] = channel
+			recentChannels = append(recentChannels, channel)
+		}
+	}
+	// Some recent channels may be gone, keep ordinals without gaps. Old identifiers may migrate to a channel
+	// that is already in the list, it is kept at its most recent position.
+	sort.SliceStable(recentChannels, func(i, j int) bool { return recentChannels[i].RecentOrdinal < recentChannels[j].RecentOrdinal })
+	seen := make(map[string]bool)
+	ordinal := 0
+	for _, channel := range recentChannels {
+		key := channel.CategoryID + ":" + channel.ID
+		if seen[key] {
+			migrated = true
+			continue
 		}
+		seen[key] = true
+		ordinal++
+		channel.RecentOrdinal = ordinal
+		playlist.Categories[channel.CategoryID].Channels[channel.ID] = channel
 	}
 	for _, favorite := range config.Current.Favorites {
 		parts := strings.Split(favorite, ":")
+		if len(parts) < 2 {
+			continue
+		}
 		categoryID := parts[0]
 		channelID := parts[1]
-		channel, err := playlist.GetChannel(categoryID, channelID)
+		channel, err := playlist.getOrMigrateChannel(categoryID, channelID, &migrated)
 		if err != nil {
 			logging.Warn(err)
 		} else {
 			channel.IsFavorite = true
-			playlist.Categories[categoryID].Channels[channelID] = channel
+			playlist.Categories[categoryID].Channels[channel.ID] = channel
+		}
+	}
+	for _, proxied := range config.Current.Proxied {
+		parts := strings.Split(proxied, ":")
+		if len(parts) < 2 {
+			continue
+		}
+		channel, err := playlist.GetChannel(parts[0], parts[1])
+		if err != nil {
+			logging.Warn(err)
+		} else {
+			channel.IsProxied = true
+			playlist.Categories[channel.CategoryID].Channels[channel.ID] = channel
+		}
+	}
+	if migrated {
+		logging.Info("Migrating recent and favorite channels to stable channel identifiers")
+		err := config.Current.SaveRecents(channelsToString(playlist.GetRecentChannels(), true))
+		if err != nil {
+			logging.Warn(err)
+		}
+		err = config.Current.SaveFavorites(channelsToString(playlist.GetFavoriteChannels(), false))
+		if err != nil {
+			logging.Warn(err)
 		}
 	}
-	singleton = &playlist
-	return
 }
 
-// GetPlaylist returns singleton
+// GetPlaylist returns current playlist of the store. Returned playlist must not be modified.
 func GetPlaylist() *Playlist {
-	return singleton
+	return store.Get()
 }
 
 // ParseM3U parses an m3u list.
-// Modified code of https://github.com/jamesnetherton/m3u/blob/master/m3u.go
 func ParseM3U(fileNameOrURL string) (playlist Playlist, err error) {
+	return parseSource(config.Source{Path: fileNameOrURL})
+}
+
+// parseSource parses m3u list of a source. Categories are prefixed with category prefix of source.
+// Modified code of https://github.com/jamesnetherton/m3u/blob/master/m3u.go
+func parseSource(source config.Source) (playlist Playlist, err error) {
+	fileNameOrURL := source.Path
 
 	var f io.ReadCloser
 	var data *http.Response
 	if strings.HasPrefix(fileNameOrURL, "http://") || strings.HasPrefix(fileNameOrURL, "https://") {
 		data, err = http.Get(fileNameOrURL)
-		f = data.Body
+		if err == nil {
+			f = data.Body
+		}
 	} else {
 		f, err = os.Open(fileNameOrURL)
 	}
@@ -82,42 +160,89 @@ func ParseM3U(fileNameOrURL string) (playlist Playlist, err error) {
 	defer f.Close()
 
 	onFirstLine := true
+	order := 0
 	scanner := bufio.NewScanner(f)
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	// An #EXTINF line that is read while looking for media URL of previous channel is processed next
+	pending := ""
+	for pending != "" || scanner.Scan() {
+		line := pending
+		pending = ""
+		if line == "" {
+			line = scanner.Text()
+		}
+		if onFirstLine {
+			line = strings.TrimPrefix(line, "\uFEFF")
+		}
 		if onFirstLine && !strings.HasPrefix(line, "#EXTM3U") {
 			err = errors.New("Invalid m3u file format. Expected #EXTM3U file header")
 			return
 		}
 
+		if onFirstLine {
+			playlist.EPGPath = parseHeader(line)
+		}
+
 		onFirstLine = false
 
 		// Find #EXTINF prefixes
 		if strings.HasPrefix(line, "#EXTINF") {
-			line := strings.Replace(line, "#EXTINF:", "", -1)
-			channelInfo := strings.Split(line, ",")
-			if len(channelInfo) < 2 {
-				err = errors.New("Invalid m3u file format. Expected EXTINF metadata to contain tvg attributes and channel name")
-				return
+			info, parseErr := parseEXTINF(line)
+			if parseErr != nil {
+				// Media URL on next line is skipped as it is not an #EXTINF line
+				logging.Warn(parseErr.Error() + ": " + line)
+				continue
+			}
+			category, tvgID, tvgName := parseAttributes(info.Attributes)
+			// Options may come between #EXTINF and m3u8 url
+			vlcOptions := make(map[string]string)
+			kodiProps := make(map[string]string)
+			mediaURL := ""
+			for mediaURL == "" && pending == "" && scanner.Scan() {
+				next := strings.TrimSpace(scanner.Text())
+				switch {
+				case strings.HasPrefix(next, "#EXTVLCOPT:"):
+					parseDirective(next, "#EXTVLCOPT:", vlcOptions)
+				case strings.HasPrefix(next, "#KODIPROP:"):
+					parseDirective(next, "#KODIPROP:", kodiProps)
+				case strings.HasPrefix(next, "#EXTGRP:") && info.Attributes["group-title"] == "":
+					category = strings.TrimSpace(strings.TrimPrefix(next, "#EXTGRP:"))
+				case strings.HasPrefix(next, "#EXTINF"):
+					pending = next
+				case next == "" || strings.HasPrefix(next, "#"):
+				default:
+					mediaURL = next
+				}
 			}
-			attributes := channelInfo[0]
-			title := channelInfo[1]
-			category, id, logo, description := parseAttributes(attributes, title)
+			if mediaURL == "" {
+				logging.Warn("Channel has no media URL, it is skipped: " + line)
+				continue
+			}
+			mediaURL, httpHeaders := streamHeaders(mediaURL, vlcOptions, kodiProps)
+			if category == "" {
+				category = "Uncategorized"
+			}
+			category = source.CategoryPrefix + category
 			categoryID := hex.EncodeToString([]byte(category))
-			// Next line is m3u8 url
-			scanner.Scan()
-			mediaURL := scanner.Text()
 
 			channel := Channel{
-				ID:          id,
-				Title:       title,
+				Title:       info.Title,
+				Duration:    info.Duration,
+				Attributes:  info.Attributes,
 				MediaURL:    mediaURL,
-				Logo:        logo,
-				Description: description,
+				VLCOptions:  vlcOptions,
+				KodiProps:   kodiProps,
+				HTTPHeaders: httpHeaders,
+				Logo:        missing, // Resolved when sources are merged, see resolveLogos
+				LogoHD:      missing,
+				TvgID:       tvgID,
+				TvgName:     tvgName,
 				Category:    category,
 				CategoryID:  categoryID,
+				Source:      source.Name,
+				Order:       order,
 			}
+			order++
 
 			if playlist.Categories == nil {
 				playlist.Categories = make(map[string]Category)
@@ -126,9 +251,11 @@ func ParseM3U(fileNameOrURL string) (playlist Playlist, err error) {
 				playlist.Categories[categoryID] = Category{
 					ID:       categoryID,
 					Name:     category,
+					Order:    channel.Order,
 					Channels: make(map[string]Channel),
 				}
 			}
+			channel.ID = generateChannelID(channel, playlist.Categories[categoryID].Channels)
 			if _, ok := playlist.Categories[categoryID].Channels[channel.ID]; !ok {
 				playlist.Categories[categoryID].Channels[channel.ID] = channel
 			}
@@ -137,35 +264,85 @@ func ParseM3U(fileNameOrURL string) (playlist Playlist, err error) {
 	return playlist, err
 }
 
-func parseAttributes(attributes string, title string) (category string, id string, logo string, description string) {
-	tagsRegExp, _ := regexp.Compile("([a-zA-Z0-9-]+?)=\"([^\"]+)\"")
-	tags := tagsRegExp.FindAllString(attributes, -1)
-	category = "Uncategorized"
-	id = title + uuid.New().String()
-	logo = ""
-	description = "TODO EPG"
-
-	for i := range tags {
-		tagParts := strings.Split(tags[i], "=")
-		tagKey := tagParts[0]
-		tagValue := strings.Replace(tagParts[1], "\"", "", -1)
-		if tagKey == "group-title" {
-			category = tagValue
-		}
-		// if tagKey == "tvg-id" {
-		// 	id = tagValue
-		// }
-		if tagKey == "tvg-logo" {
-			logo = tagValue
-		}
-		if tagKey == "tvg-url" {
-			description = tagValue
-		}
-	}
-	id = hex.EncodeToString([]byte(id))
-	//logo, err := computeChannelLogo(id, logo)
-	// if err != nil {
-	// 	logging.Warn("Error while fetching channel logo for channel " + title + ". " + err.Error())
-	// }
-	return category, id, logo, description
+// parseHeader returns EPG address from #EXTM3U header, x-tvg-url takes precedence over url-tvg.
+func parseHeader(header string) (epgPath string) {
+	attributes, _, _ := parseAttributeList(strings.TrimPrefix(header, "#EXTM3U"))
+	if epgPath = attributes["x-tvg-url"]; epgPath == "" {
+		epgPath = attributes["url-tvg"]
+	}
+	return epgPath
+}
+
+func parseAttributes(attributes map[string]string) (category string, tvgID string, tvgName string) {
+	category = attributes["group-title"]
+	tvgID = attributes["tvg-id"]
+	tvgName = attributes["tvg-name"]
+	return category, tvgID, tvgName
+}
+
+// generateChannelID returns a stable identifier that survives playlist reloads and restarts.
+// tvg-id is used if present and not taken by another channel in the same category.
+// Otherwise a hash of normalized title, media URL and category is used.
+// Query string of media URL is ignored, because providers rotate stream tokens.
+func generateChannelID(channel Channel, categoryChannels map[string]Channel) string {
+	if channel.TvgID != "" {
+		id := hex.EncodeToString([]byte(channel.TvgID))
+		if _, ok := categoryChannels[id]; !ok {
+			return id
+		}
+	}
+	mediaURL := channel.MediaURL
+	if i := strings.IndexAny(mediaURL, "?#"); i >= 0 {
+		mediaURL = mediaURL[:i]
+	}
+	title := strings.Join(strings.Fields(strings.ToLower(channel.Title)), " ")
+	hash := sha256.Sum256([]byte(title + "\n" + mediaURL + "\n" + channel.Category))
+	return hex.EncodeToString(hash[:16])
+}
+
+// getOrMigrateChannel gets channel, trying older identifier scheme if it can not be found. Sets migrated if so.
+func (playlist *Playlist) getOrMigrateChannel(category string, channel string, migrated *bool) (value Channel, err error) {
+	value, err = playlist.GetChannel(category, channel)
+	if err == nil {
+		return value, nil
+	}
+	value, err = playlist.migrateChannelID(category, channel)
+	if err != nil {
+		return value, err
+	}
+	*migrated = true
+	return value, nil
+}
+
+// migrateChannelID finds channel of an identifier generated by older versions, which were
+// hex encoded channel title followed by a random uuid. Channel is matched by title in the same category,
+// it is not migrated if more than one channel has that title.
+func (playlist *Playlist) migrateChannelID(category string, oldID string) (value Channel, err error) {
+	decoded, err := hex.DecodeString(oldID)
+	if err != nil || len(decoded) <= 36 {
+		return value, errors.New("Channel could not be found")
+	}
+	if _, err := uuid.ParseBytes(decoded[len(decoded)-36:]); err != nil {
+		return value, errors.New("Channel could not be found")
+	}
+	title := string(decoded[:len(decoded)-36])
+	cat, err := playlist.GetCategory(category)
+	if err != nil {
+		return value, err
+	}
+	found := 0
+	for _, channel := range cat.Channels {
+		if channel.Title == title {
+			value = channel
+			found++
+		}
+	}
+	switch found {
+	case 0:
+		return value, errors.New("Channel could not be found")
+	case 1:
+		return value, nil
+	default:
+		return Channel{}, errors.New("Channel could not be migrated, " + strconv.Itoa(found) + " channels are named " + title + " in " + cat.Name)
+	}
 }
@@ -4,19 +4,23 @@ import (
 	"errors"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/epg"
 )
 
 // Playlist struct defines a M3U playlist. M3U playlist starts with #EXTM3U line.
 type Playlist struct {
 	Categories map[string]Category
+	EPGPath    string // x-tvg-url or url-tvg attribute of #EXTM3U header, comma separated if there are multiple sources
 }
 
 // Category in a M3U playlist, group-title attribute.
 type Category struct {
 	ID       string
 	Name     string
+	Order    int // Position of first channel of category in playlist
 	Channels map[string]Channel
 }
 
@@ -24,20 +28,60 @@ type Category struct {
 // #EXTINF:-1 tvg-id="" tvg-name="" tvg-country="" tvg-language="" tvg-logo="" tvg-url="" group-title="",Channel Name
 // https://channel.url/stream.m3u8
 type Channel struct {
-	ID            string // tvg-id or .Title. Spaces are replaced with underscore.
-	Title         string // Channel title, string that comes after comma
-	MediaURL      string // Second line after #EXTINF:-...
-	Logo          string // tvg-logo or placeholder. missing_logo aspect ratio
-	Description   string // Unused for now, will be used for EPG implementation
-	Category      string // group-title or Uncategorized if missing
-	CategoryID    string // For link generation purposes
-	IsRecent      bool   // Is channel recently watched?
-	RecentOrdinal int    // Recent watch order
-	IsFavorite    bool   // Is channel favorite?
+	ID            string            // Hex encoded tvg-id, or hash of title, media URL and category. Stable between reloads.
+	Title         string            // Channel title, string that comes after first unquoted comma
+	Duration      float64           // Duration in #EXTINF, -1 for live streams
+	Attributes    map[string]string // All attributes in #EXTINF, keys are lower case
+	MediaURL      string            // First line after #EXTINF:-... that is not a comment or option
+	VLCOptions    map[string]string // #EXTVLCOPT:key=value lines
+	KodiProps     map[string]string // #KODIPROP:key=value lines
+	HTTPHeaders   map[string]string // Headers sent when fetching stream, from options or url|Header=value suffix
+	Logo          string            // Cached 720p logo or missing logo, relative to server root. Logos are fetched in background
+	LogoHD        string            // Cached 1080p logo or missing logo, relative to server root
+	TvgID         string            // tvg-id, used for matching EPG channels
+	TvgName       string            // tvg-name, used for matching EPG channels if tvg-id does not match
+	Category      string            // group-title or Uncategorized if missing
+	CategoryID    string            // For link generation purposes
+	Source        string            // Name of playlist source that channel comes from
+	Order         int               // Position in playlist, channels of sources that come first in config come first
+	Number        int               // tvg-chno, or a number after the highest tvg-chno if missing. Unique in playlist
+	IsRecent      bool              // Is channel recently watched?
+	RecentOrdinal int               // Recent watch order
+	IsFavorite    bool              // Is channel favorite?
+	IsProxied     bool              // Is channel streamed through appletv3-iptv?
+}
+
+// UsesProxy - Is channel streamed through appletv3-iptv, either selected per channel or for all channels?
+// Channels that need custom HTTP headers are always proxied, Apple TV can not send them.
+func (channel Channel) UsesProxy() bool {
+	return channel.IsProxied || config.Current.ProxyAll || len(channel.HTTPHeaders) > 0
+}
+
+// GetCurrentProgramme - Gets programme on air from EPG, nil if EPG is not available.
+func (channel Channel) GetCurrentProgramme() *epg.Programme {
+	guide := epg.GetGuide()
+	return guide.GetProgrammeAt(guide.FindChannel(channel.TvgID, channel.TvgName, channel.Title), time.Now())
+}
+
+// GetNextProgramme - Gets programme that comes after current one from EPG, nil if EPG is not available.
+func (channel Channel) GetNextProgramme() *epg.Programme {
+	guide := epg.GetGuide()
+	return guide.GetNextProgramme(guide.FindChannel(channel.TvgID, channel.TvgName, channel.Title), time.Now())
+}
+
+// getCategories - Gets categories, nil safe.
+func (playlist *Playlist) getCategories() map[string]Category {
+	if playlist == nil {
+		return nil
+	}
+	return playlist.Categories
 }
 
 // GetCategory - Gets Category and its children in current playlist.
 func (playlist *Playlist) GetCategory(category string) (value Category, err error) {
+	if playlist == nil {
+		return value, errors.New("Playlist is not loaded")
+	}
 	if value, ok := playlist.Categories[category]; ok {
 		return value, nil
 	}
@@ -56,6 +100,26 @@ func (playlist *Playlist) GetChannel(category string, channel string) (value Cha
 	return value, errors.New("Channel could not be found")
 }
 
+// GetEPGPath - Gets EPG address advertised in playlist header.
+func (playlist *Playlist) GetEPGPath() string {
+	if playlist == nil {
+		return ""
+	}
+	return playlist.EPGPath
+}
+
+// GetChannelByNumber - Gets channel with given channel number.
+func (playlist *Playlist) GetChannelByNumber(number int) (value Channel, err error) {
+	for _, category := range playlist.getCategories() {
+		for _, channel := range category.Channels {
+			if channel.Number == number {
+				return channel, nil
+			}
+		}
+	}
+	return value, errors.New("Channel number could not be found: " + strconv.Itoa(number))
+}
+
 // GetChannelsCount - Gets count of all channels.
 func (playlist *Playlist) GetChannelsCount() (count int) {
 	count = 0
@@ -68,6 +132,18 @@ func (playlist *Playlist) GetChannelsCount() (count int) {
 	return count
 }
 
+// GetSourceChannelsCount - Gets count of channels that come from given source.
+func (playlist *Playlist) GetSourceChannelsCount(source string) (count int) {
+	for _, category := range playlist.getCategories() {
+		for _, channel := range category.Channels {
+			if channel.Source == source {
+				count++
+			}
+		}
+	}
+	return count
+}
+
 // GetRecentChannelsCount - Gets count of recently watched channels.
 func (playlist *Playlist) GetRecentChannelsCount() (count int) {
 	count = 0
@@ -117,8 +193,12 @@ func (playlist *Playlist) GetRecentChannels() (recentChannels []Channel) {
 	return recentChannels
 }
 
-// SetRecentChannel - Sets selected channel as recent and updates order of other channels.
-func (playlist *Playlist) SetRecentChannel(selectedChannel Channel) error {
+// setRecentChannel - Sets selected channel as recent and updates order of other channels.
+func (playlist *Playlist) setRecentChannel(category string, channel string) error {
+	selectedChannel, err := playlist.GetChannel(category, channel)
+	if err != nil {
+		return err
+	}
 	for _, channel := range playlist.GetRecentChannels() {
 		if selectedChannel.IsRecent {
 			if channel.ID != selectedChannel.ID && selectedChannel.RecentOrdinal > channel.RecentOrdinal {
@@ -136,8 +216,8 @@ func (playlist *Playlist) SetRecentChannel(selectedChannel Channel) error {
 	return config.Current.SaveRecents(channelsToString(playlist.GetRecentChannels(), true))
 }
 
-// ClearRecentChannels - Clears recent channel list.
-func (playlist *Playlist) ClearRecentChannels() error {
+// clearRecentChannels - Clears recent channel list.
+func (playlist *Playlist) clearRecentChannels() error {
 	for _, channel := range playlist.GetRecentChannels() {
 		channel.IsRecent = false
 		playlist.Categories[channel.CategoryID].Channels[channel.ID] = channel
@@ -145,7 +225,7 @@ func (playlist *Playlist) ClearRecentChannels() error {
 	return config.Current.ClearRecents()
 }
 
-// GetFavoriteChannels - Gets favorite channels.
+// GetFavoriteChannels - Gets favorite channels in sort order of config.
 func (playlist *Playlist) GetFavoriteChannels() (favoriteChannels []Channel) {
 	for _, category := range playlist.Categories {
 		for _, channel := range category.Channels {
@@ -154,11 +234,12 @@ func (playlist *Playlist) GetFavoriteChannels() (favoriteChannels []Channel) {
 			}
 		}
 	}
+	SortChannels(favoriteChannels)
 	return favoriteChannels
 }
 
-// ToggleFavoriteChannel - Clears favorite channel list.
-func (playlist *Playlist) ToggleFavoriteChannel(category string, channel string) (err error) {
+// toggleFavoriteChannel - Adds channel to or removes channel from favorites.
+func (playlist *Playlist) toggleFavoriteChannel(category string, channel string) (err error) {
 	selectedChannel, err := playlist.GetChannel(category, channel)
 	if err != nil {
 		return err
@@ -169,8 +250,8 @@ func (playlist *Playlist) ToggleFavoriteChannel(category string, channel string)
 	return err
 }
 
-// ClearFavoriteChannels - Clears favorite channel list.
-func (playlist *Playlist) ClearFavoriteChannels() error {
+// clearFavoriteChannels - Clears favorite channel list.
+func (playlist *Playlist) clearFavoriteChannels() error {
 	for _, channel := range playlist.GetFavoriteChannels() {
 		channel.IsFavorite = false
 		playlist.Categories[channel.CategoryID].Channels[channel.ID] = channel
@@ -178,6 +259,45 @@ func (playlist *Playlist) ClearFavoriteChannels() error {
 	return config.Current.ClearFavorites()
 }
 
+// GetProxiedChannels - Gets channels that are selected to be streamed through appletv3-iptv, in sort order of config.
+func (playlist *Playlist) GetProxiedChannels() (proxiedChannels []Channel) {
+	for _, category := range playlist.Categories {
+		for _, channel := range category.Channels {
+			if channel.IsProxied {
+				proxiedChannels = append(proxiedChannels, channel)
+			}
+		}
+	}
+	SortChannels(proxiedChannels)
+	return proxiedChannels
+}
+
+// toggleProxiedChannel - Selects or unselects channel to be streamed through appletv3-iptv.
+func (playlist *Playlist) toggleProxiedChannel(category string, channel string) (err error) {
+	selectedChannel, err := playlist.GetChannel(category, channel)
+	if err != nil {
+		return err
+	}
+	selectedChannel.IsProxied = !selectedChannel.IsProxied
+	playlist.Categories[category].Channels[channel] = selectedChannel
+	return config.Current.SaveProxied(channelsToString(playlist.GetProxiedChannels(), false))
+}
+
+// clone - Copies playlist deep enough that changing channels of copy does not affect original.
+func (playlist *Playlist) clone() *Playlist {
+	copied := *playlist
+	copied.Categories = make(map[string]Category, len(playlist.Categories))
+	for categoryID, category := range playlist.Categories {
+		channels := make(map[string]Channel, len(category.Channels))
+		for channelID, channel := range category.Channels {
+			channels[channelID] = channel
+		}
+		category.Channels = channels
+		copied.Categories[categoryID] = category
+	}
+	return &copied
+}
+
 // SearchChannels - Searches channel titles with the given term, case insensitive.
 func (playlist *Playlist) SearchChannels(term string) (searchResults Playlist) {
 	searchResults = Playlist{}
@@ -189,7 +309,9 @@ func (playlist *Playlist) SearchChannels(term string) (searchResults Playlist) {
 				}
 				if _, ok := searchResults.Categories[categoryKey]; !ok {
 					searchResults.Categories[categoryKey] = Category{
+						ID:       categoryValue.ID,
 						Name:     categoryValue.Name,
+						Order:    categoryValue.Order,
 						Channels: make(map[string]Channel),
 					}
 				}
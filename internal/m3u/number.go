@@ -0,0 +1,45 @@
+package m3u
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// numberChannels sets channel numbers from tvg-chno attribute. Channels without a valid number, or with a number
+// that is taken by a channel that comes before in playlist, are numbered after the highest tvg-chno in playlist order.
+func numberChannels(playlist *Playlist) {
+	var channels []Channel
+	for _, category := range playlist.getCategories() {
+		for _, channel := range category.Channels {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		if channels[i].Order != channels[j].Order {
+			return channels[i].Order < channels[j].Order
+		}
+		return channels[i].ID < channels[j].ID
+	})
+	taken := make(map[int]bool)
+	highest := 0
+	var unnumbered []Channel
+	for _, channel := range channels {
+		number, err := strconv.Atoi(strings.TrimSpace(channel.Attributes["tvg-chno"]))
+		if err != nil || number < 1 || taken[number] {
+			unnumbered = append(unnumbered, channel)
+			continue
+		}
+		taken[number] = true
+		if number > highest {
+			highest = number
+		}
+		channel.Number = number
+		playlist.Categories[channel.CategoryID].Channels[channel.ID] = channel
+	}
+	for _, channel := range unnumbered {
+		highest++
+		channel.Number = highest
+		playlist.Categories[channel.CategoryID].Channels[channel.ID] = channel
+	}
+}
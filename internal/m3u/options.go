@@ -0,0 +1,71 @@
+package m3u
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// VLC options that are sent as HTTP headers when fetching stream.
+var vlcOptionHeaders = map[string]string{
+	"http-user-agent": "User-Agent",
+	"http-referrer":   "Referer",
+	"http-referer":    "Referer",
+	"http-origin":     "Origin",
+	"http-cookie":     "Cookie",
+}
+
+// parseDirective parses "#EXTVLCOPT:key=value" and "#KODIPROP:key=value" lines into given options.
+func parseDirective(line string, prefix string, options map[string]string) {
+	option := strings.TrimSpace(strings.TrimPrefix(line, prefix))
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return
+	}
+	options[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+}
+
+// parseHeaderPairs parses Kodi style header lists like "User-Agent=foo&Referer=http%3A%2F%2Fbar" into headers.
+func parseHeaderPairs(pairs string, headers map[string]string) {
+	for _, pair := range strings.Split(pairs, "&") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		value, err := url.QueryUnescape(parts[1])
+		if err != nil {
+			value = parts[1]
+		}
+		headers[http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))] = value
+	}
+}
+
+// streamHeaders collects HTTP headers of a channel from VLC options, Kodi properties and
+// Kodi style media URL suffix (https://host/stream.m3u8|User-Agent=foo). Returns media URL without suffix.
+func streamHeaders(mediaURL string, vlcOptions map[string]string, kodiProps map[string]string) (string, map[string]string) {
+	headers := make(map[string]string)
+	for option, value := range vlcOptions {
+		if header, ok := vlcOptionHeaders[option]; ok {
+			headers[header] = value
+		}
+	}
+	for _, prop := range []string{"inputstream.adaptive.manifest_headers", "inputstream.adaptive.stream_headers"} {
+		if value, ok := kodiProps[prop]; ok {
+			parseHeaderPairs(value, headers)
+		}
+	}
+	if i := strings.Index(mediaURL, "|"); i >= 0 {
+		parseHeaderPairs(mediaURL[i+1:], headers)
+		mediaURL = mediaURL[:i]
+	}
+	return mediaURL, headers
+}
+
+// GetHTTPHeaders - Gets headers that must be sent when fetching stream of channel.
+func (channel Channel) GetHTTPHeaders() http.Header {
+	headers := make(http.Header)
+	for header, value := range channel.HTTPHeaders {
+		headers.Set(header, value)
+	}
+	return headers
+}
@@ -0,0 +1,120 @@
+package m3u
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/logging"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Picons are logo packs in a local directory. Files are named by normalized channel name, for example
+// bbcone.png, or by Enigma2 service reference, for example 1_0_19_1B1D_802_2_11A0000_0_0_0.png.
+// Logo key of channels that match a picon starts with piconPrefix, followed by picon file path.
+const piconPrefix = "picon:"
+
+var (
+	piconIndex map[string]string // Normalized picon name to file path
+	piconMutex sync.RWMutex
+
+	// Letters that are not decomposed into a base letter and an accent
+	piconReplacer = strings.NewReplacer("ı", "i", "ß", "ss", "ø", "o", "æ", "ae", "œ", "oe", "ł", "l", "đ", "d", "&", "and", "+", "plus", "*", "star")
+	// Quality suffixes that picon packs usually leave out
+	piconSuffixes = []string{"uhd", "fhd", "hd", "sd", "4k"}
+)
+
+// normalizePiconName lower cases name, removes accents and keeps only letters and digits.
+func normalizePiconName(name string) string {
+	name = piconReplacer.Replace(strings.ToLower(name))
+	name, _, _ = transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), name)
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+// loadPicons indexes picon directory. Index is emptied if picon path is not set.
+func loadPicons() {
+	index := make(map[string]string)
+	if config.Current.PiconPath != "" {
+		files, err := ioutil.ReadDir(config.Current.PiconPath)
+		if err != nil {
+			logging.Warn("Error while reading picon directory. " + err.Error())
+		}
+		for _, file := range files {
+			extension := strings.ToLower(filepath.Ext(file.Name()))
+			if file.IsDir() || (extension != ".png" && extension != ".jpg" && extension != ".jpeg") {
+				continue
+			}
+			name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+			// Service references are kept as they are, upper cased
+			if strings.Count(name, "_") >= 9 {
+				index[strings.ToUpper(name)] = filepath.Join(config.Current.PiconPath, file.Name())
+				continue
+			}
+			index[normalizePiconName(name)] = filepath.Join(config.Current.PiconPath, file.Name())
+		}
+	}
+	piconMutex.Lock()
+	piconIndex = index
+	piconMutex.Unlock()
+}
+
+// findPicon returns picon file of channel, empty string if there is none. tvg-id is tried as service
+// reference, then tvg-name and channel title are tried with and without quality suffixes.
+func findPicon(channel Channel) string {
+	piconMutex.RLock()
+	defer piconMutex.RUnlock()
+	if len(piconIndex) == 0 {
+		return ""
+	}
+	if channel.TvgID != "" {
+		reference := strings.ToUpper(strings.Trim(strings.ReplaceAll(channel.TvgID, ":", "_"), "_"))
+		if path, ok := piconIndex[reference]; ok {
+			return path
+		}
+	}
+	for _, name := range []string{channel.TvgName, channel.Title} {
+		normalized := normalizePiconName(name)
+		if normalized == "" {
+			continue
+		}
+		if path, ok := piconIndex[normalized]; ok {
+			return path
+		}
+		for _, suffix := range piconSuffixes {
+			if strings.HasSuffix(normalized, suffix) {
+				if path, ok := piconIndex[strings.TrimSuffix(normalized, suffix)]; ok {
+					return path
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// reportPicons logs channels that did not match any picon.
+func reportPicons(playlist *Playlist) {
+	if config.Current.PiconPath == "" {
+		return
+	}
+	var unmatched []Channel
+	for _, category := range playlist.getCategories() {
+		for _, channel := range category.Channels {
+			if !strings.HasPrefix(logoKey(channel), piconPrefix) {
+				unmatched = append(unmatched, channel)
+			}
+		}
+	}
+	logging.Info(strconv.Itoa(playlist.GetChannelsCount()-len(unmatched)) + " channels matched a picon, " +
+		strconv.Itoa(len(unmatched)) + " did not. " + summarizeTitles(unmatched))
+}
@@ -0,0 +1,140 @@
+package m3u
+
+import (
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Channels without tvg-logo get a generated logo, channel name on a colour derived from the name.
+// Logo key of such channels starts with placeholderPrefix, they are cached like fetched logos.
+const placeholderPrefix = "placeholder:"
+
+var (
+	placeholderFont     *opentype.Font
+	placeholderFontErr  error
+	placeholderFontOnce sync.Once
+)
+
+// logoKey returns picon key if channel matches a picon, otherwise address of channel logo,
+// or placeholder key if channel does not have one.
+func logoKey(channel Channel) string {
+	if picon := findPicon(channel); picon != "" {
+		return piconPrefix + picon
+	}
+	if rawLogo := channel.Attributes["tvg-logo"]; rawLogo != "" {
+		return rawLogo
+	}
+	return placeholderPrefix + channel.Title
+}
+
+// placeholderColor returns a dark colour, so that white text is readable. Same name gets same colour.
+func placeholderColor(name string) color.NRGBA {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	hue := float64(hash.Sum32()%360) / 60
+	// HSL to RGB with saturation 0.5 and lightness 0.35
+	chroma := 0.35
+	x := chroma * (1 - abs(mod2(hue)-1))
+	var r, g, b float64
+	switch int(hue) {
+	case 0:
+		r, g = chroma, x
+	case 1:
+		r, g = x, chroma
+	case 2:
+		g, b = chroma, x
+	case 3:
+		g, b = x, chroma
+	case 4:
+		r, b = x, chroma
+	default:
+		r, b = chroma, x
+	}
+	m := 0.35 - chroma/2
+	return color.NRGBA{R: uint8((r + m) * 255), G: uint8((g + m) * 255), B: uint8((b + m) * 255), A: 255}
+}
+
+func abs(value float64) float64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+func mod2(value float64) float64 {
+	return value - float64(int(value/2)*2)
+}
+
+// initials returns first letters of up to three words of name.
+func initials(name string) string {
+	var builder strings.Builder
+	for _, word := range strings.Fields(name) {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				builder.WriteRune(unicode.ToUpper(r))
+				break
+			}
+		}
+		if builder.Len() >= 3 {
+			break
+		}
+	}
+	return builder.String()
+}
+
+// renderPlaceholder draws channel name in the middle of an image of given size. If name does not
+// fit even with a small font, initials of name are drawn instead.
+func renderPlaceholder(name string, width uint, height uint) (image.Image, error) {
+	placeholderFontOnce.Do(func() {
+		placeholderFont, placeholderFontErr = opentype.Parse(gobold.TTF)
+	})
+	if placeholderFontErr != nil {
+		return nil, placeholderFontErr
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(placeholderColor(name)), image.Point{}, draw.Src)
+
+	maxWidth := fixed.I(int(width) * 85 / 100)
+	text := strings.TrimSpace(name)
+	var face font.Face
+	for _, size := range []float64{0.22, 0.18, 0.14} {
+		var err error
+		face, err = opentype.NewFace(placeholderFont, &opentype.FaceOptions{Size: float64(height) * size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, err
+		}
+		if font.MeasureString(face, text) <= maxWidth {
+			break
+		}
+		face.Close()
+		face = nil
+	}
+	if face == nil {
+		text = initials(name)
+		var err error
+		face, err = opentype.NewFace(placeholderFont, &opentype.FaceOptions{Size: float64(height) * 0.4, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	drawer := &font.Drawer{Dst: canvas, Src: image.White, Face: face}
+	drawer.Dot = fixed.Point26_6{
+		X: (fixed.I(int(width)) - drawer.MeasureString(text)) / 2,
+		Y: (fixed.I(int(height)) + metrics.Ascent - metrics.Descent) / 2,
+	}
+	drawer.DrawString(text)
+	return canvas, nil
+}
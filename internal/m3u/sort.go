@@ -0,0 +1,73 @@
+package m3u
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ghokun/appletv3-iptv/internal/config"
+)
+
+// Sort orders of channels and categories, set by sortOrder in config. Playlist order is the default.
+const (
+	SortByPlaylist = "playlist" // Order in M3U files, sources in order of config
+	SortByName     = "name"     // Alphabetical, case insensitive
+	SortByNumber   = "number"   // Channel number, see numberChannels. Categories in playlist order
+)
+
+// channelLess - Does left channel come before right one in sort order of config? Ties are broken by playlist order.
+func channelLess(left Channel, right Channel) bool {
+	switch config.Current.SortOrder {
+	case SortByName:
+		leftTitle, rightTitle := strings.ToLower(left.Title), strings.ToLower(right.Title)
+		if leftTitle != rightTitle {
+			return leftTitle < rightTitle
+		}
+	case SortByNumber:
+		if left.Number != right.Number {
+			return left.Number < right.Number
+		}
+	}
+	if left.Order != right.Order {
+		return left.Order < right.Order
+	}
+	return left.ID < right.ID
+}
+
+// SortChannels - Sorts channels with sort order in config.
+func SortChannels(channels []Channel) {
+	sort.Slice(channels, func(i, j int) bool { return channelLess(channels[i], channels[j]) })
+}
+
+// SortCategories - Sorts categories by name if sort order in config is name, otherwise by playlist order.
+func SortCategories(categories []Category) {
+	sort.Slice(categories, func(i, j int) bool {
+		if config.Current.SortOrder == SortByName {
+			left, right := strings.ToLower(categories[i].Name), strings.ToLower(categories[j].Name)
+			if left != right {
+				return left < right
+			}
+		}
+		if categories[i].Order != categories[j].Order {
+			return categories[i].Order < categories[j].Order
+		}
+		return categories[i].ID < categories[j].ID
+	})
+}
+
+// GetSortedCategories - Gets categories of playlist in sort order of config.
+func (playlist *Playlist) GetSortedCategories() (categories []Category) {
+	for _, category := range playlist.getCategories() {
+		categories = append(categories, category)
+	}
+	SortCategories(categories)
+	return categories
+}
+
+// GetSortedChannels - Gets channels of category in sort order of config.
+func (category Category) GetSortedChannels() (channels []Channel) {
+	for _, channel := range category.Channels {
+		channels = append(channels, channel)
+	}
+	SortChannels(channels)
+	return channels
+}
@@ -0,0 +1,212 @@
+package m3u
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/logging"
+)
+
+var (
+	// Last successfully parsed playlist of each source, so that a source can be reloaded
+	// or enabled without fetching others, and a failing source keeps its previous channels.
+	sourcePlaylists = make(map[string]Playlist)
+	sourcesMutex    sync.Mutex
+)
+
+func sourceKey(source config.Source) string {
+	return source.Name + "\n" + source.Path
+}
+
+// loadSources parses given sources. Errors are logged, the last error is returned.
+func loadSources(sources []config.Source) (err error) {
+	for _, source := range sources {
+		logging.Info("Loading channels of source " + source.Name + " from: " + source.Path)
+		playlist, parseErr := parseSource(source)
+		if parseErr != nil {
+			logging.Warn("Error while loading source " + source.Name + ", previously loaded channels of it are kept. " + parseErr.Error())
+			err = parseErr
+			continue
+		}
+		sourcesMutex.Lock()
+		sourcePlaylists[sourceKey(source)] = playlist
+		sourcesMutex.Unlock()
+	}
+	return err
+}
+
+// publish merges playlists of enabled sources and replaces current playlist.
+// Loads recent and favorite channels from config file if exist.
+// Lock is held until playlist is replaced, so that an older merge can not replace a newer one.
+func publish() error {
+	sourcesMutex.Lock()
+	defer sourcesMutex.Unlock()
+	var playlists []Playlist
+	for _, source := range config.Current.GetSources() {
+		if playlist, ok := sourcePlaylists[sourceKey(source)]; ok && !source.Disabled {
+			playlists = append(playlists, playlist)
+		}
+	}
+	playlist := mergePlaylists(playlists)
+	numberChannels(&playlist)
+	loadPicons()
+	resolveLogos(&playlist)
+	reportPicons(&playlist)
+	// Recents and favorites are read while holding the lock, so that changes made in the meantime are not lost
+	err := store.Swap(func(*Playlist) (*Playlist, error) {
+		playlist.loadRecentsAndFavorites()
+		return &playlist, nil
+	})
+	if err == nil {
+		evictLogoCache()
+		queueLogos(GetPlaylist())
+	}
+	return err
+}
+
+// mergePlaylists merges playlists in given order. Categories with the same name are merged,
+// if a channel exists in more than one playlist the first one is kept.
+func mergePlaylists(playlists []Playlist) (merged Playlist) {
+	merged.Categories = make(map[string]Category)
+	var epgPaths []string
+	// Channels of a playlist come after channels of previous playlists
+	offset := 0
+	for _, playlist := range playlists {
+		if playlist.EPGPath != "" {
+			epgPaths = append(epgPaths, playlist.EPGPath)
+		}
+		count := 0
+		for categoryID, category := range playlist.Categories {
+			if _, ok := merged.Categories[categoryID]; !ok {
+				merged.Categories[categoryID] = Category{
+					ID:       categoryID,
+					Name:     category.Name,
+					Order:    offset + category.Order,
+					Channels: make(map[string]Channel),
+				}
+			}
+			for channelID, channel := range category.Channels {
+				if channel.Order >= count {
+					count = channel.Order + 1
+				}
+				channel.Order += offset
+				if _, ok := merged.Categories[categoryID].Channels[channelID]; !ok {
+					merged.Categories[categoryID].Channels[channelID] = channel
+				}
+			}
+		}
+		offset += count
+	}
+	merged.EPGPath = strings.Join(epgPaths, ",")
+	return merged
+}
+
+func enabledSources() (sources []config.Source) {
+	for _, source := range config.Current.GetSources() {
+		if !source.Disabled {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// GeneratePlaylist loads all enabled sources and merges them into one playlist.
+// New playlist is built aside and replaces current one only when it is complete.
+// Sources that fail to load keep their previously loaded channels.
+func GeneratePlaylist() (err error) {
+	sources := enabledSources()
+	if len(sources) == 0 {
+		return errors.New("No playlist source is set")
+	}
+	err = loadSources(sources)
+	publishErr := publish()
+	if publishErr != nil {
+		return publishErr
+	}
+	return err
+}
+
+// ReloadPlaylist loads all enabled sources again and logs channels that are added or removed.
+func ReloadPlaylist() (err error) {
+	return reload(GeneratePlaylist)
+}
+
+// RefreshPlaylist loads enabled sources without refresh policy of their own again, sources with a policy
+// are reloaded by ReloadSource on their own schedule.
+func RefreshPlaylist() (err error) {
+	return reload(func() error {
+		var sources []config.Source
+		for _, source := range enabledSources() {
+			if source.RefreshInterval == "" && source.RefreshSchedule == "" {
+				sources = append(sources, source)
+			}
+		}
+		if len(sources) == 0 {
+			return nil
+		}
+		err := loadSources(sources)
+		if publishErr := publish(); publishErr != nil {
+			return publishErr
+		}
+		return err
+	})
+}
+
+// ReloadSource loads given source again and logs channels that are added or removed.
+func ReloadSource(name string) (err error) {
+	return reload(func() error {
+		for _, source := range enabledSources() {
+			if source.Name == name {
+				err := loadSources([]config.Source{source})
+				if publishErr := publish(); publishErr != nil {
+					return publishErr
+				}
+				return err
+			}
+		}
+		return errors.New("Source could not be found or is disabled: " + name)
+	})
+}
+
+// SetSourceEnabled enables or disables a source, saves it to config file and updates channel list.
+func SetSourceEnabled(name string, enabled bool) (err error) {
+	err = config.Current.SetSourceEnabled(name, enabled)
+	if err != nil {
+		return err
+	}
+	return reload(func() error {
+		var missing []config.Source
+		sourcesMutex.Lock()
+		for _, source := range enabledSources() {
+			if _, ok := sourcePlaylists[sourceKey(source)]; !ok && source.Name == name {
+				missing = append(missing, source)
+			}
+		}
+		sourcesMutex.Unlock()
+		err := loadSources(missing)
+		if publishErr := publish(); publishErr != nil {
+			return publishErr
+		}
+		return err
+	})
+}
+
+func reload(load func() error) (err error) {
+	previous := GetPlaylist()
+	logging.Info("Reloading channels...")
+	err = load()
+	if err != nil {
+		return err
+	}
+	current := GetPlaylist()
+	added, removed := current.diff(previous)
+	logging.Info("Reloaded channels. Channel count is " + strconv.Itoa(current.GetChannelsCount()) +
+		", recent channel count is " + strconv.Itoa(current.GetRecentChannelsCount()) +
+		", favorite channel count is " + strconv.Itoa(current.GetFavoriteChannelsCount()))
+	logging.Info("Added " + strconv.Itoa(len(added)) + " channels. " + summarizeTitles(added))
+	logging.Info("Removed " + strconv.Itoa(len(removed)) + " channels. " + summarizeTitles(removed))
+	return err
+}
@@ -0,0 +1,84 @@
+package m3u
+
+import (
+	"errors"
+	"sync"
+)
+
+// Store holds current playlist. Published playlists are never modified, every change is
+// applied to a copy which then replaces the current one. Therefore readers can use
+// playlist returned by Get without locking, while writers are serialized.
+type Store struct {
+	mutex    sync.RWMutex
+	playlist *Playlist
+}
+
+var store = &Store{}
+
+// Get - Gets current playlist, nil if no playlist is loaded. Returned playlist must not be modified.
+func (store *Store) Get() *Playlist {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.playlist
+}
+
+// Swap - Replaces current playlist with the one returned by build. build is called with current
+// playlist while holding the write lock, so it should not do any slow work like fetching files.
+func (store *Store) Swap(build func(current *Playlist) (*Playlist, error)) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	playlist, err := build(store.playlist)
+	if err != nil {
+		return err
+	}
+	store.playlist = playlist
+	return nil
+}
+
+// Update - Applies update to a copy of current playlist and replaces current playlist with it.
+// Current playlist stays untouched if update fails.
+func (store *Store) Update(update func(playlist *Playlist) error) error {
+	return store.Swap(func(current *Playlist) (*Playlist, error) {
+		if current == nil {
+			return nil, errors.New("Playlist is not loaded")
+		}
+		playlist := current.clone()
+		err := update(playlist)
+		return playlist, err
+	})
+}
+
+// SetRecentChannel - Sets channel as most recent in current playlist and saves recents to config file.
+func SetRecentChannel(category string, channel string) error {
+	return store.Update(func(playlist *Playlist) error {
+		return playlist.setRecentChannel(category, channel)
+	})
+}
+
+// ClearRecentChannels - Clears recent channels of current playlist and config file.
+func ClearRecentChannels() error {
+	return store.Update(func(playlist *Playlist) error {
+		return playlist.clearRecentChannels()
+	})
+}
+
+// ToggleFavoriteChannel - Adds channel to or removes channel from favorites of current playlist and config file.
+func ToggleFavoriteChannel(category string, channel string) error {
+	return store.Update(func(playlist *Playlist) error {
+		return playlist.toggleFavoriteChannel(category, channel)
+	})
+}
+
+// ClearFavoriteChannels - Clears favorite channels of current playlist and config file.
+func ClearFavoriteChannels() error {
+	return store.Update(func(playlist *Playlist) error {
+		return playlist.clearFavoriteChannels()
+	})
+}
+
+// ToggleProxiedChannel - Selects or unselects channel to be streamed through appletv3-iptv, saves selection to config file.
+func ToggleProxiedChannel(category string, channel string) error {
+	return store.Update(func(playlist *Playlist) error {
+		return playlist.toggleProxiedChannel(category, channel)
+	})
+}
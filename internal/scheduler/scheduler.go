@@ -0,0 +1,175 @@
+package scheduler
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghokun/appletv3-iptv/internal/logging"
+)
+
+// Schedule returns next run time after given time.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// Interval runs a job periodically.
+type Interval time.Duration
+
+// Next - Gets next run time.
+func (interval Interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(interval))
+}
+
+// Cron is a standard five field cron expression: minute hour day-of-month month day-of-week.
+// Fields support *, lists (1,2), ranges (1-5) and steps (*/15, 0-30/10). Day of week 0 and 7 are Sunday.
+type Cron struct {
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+	anyDay      bool // Day of month is *
+	anyWeekday  bool // Day of week is *
+}
+
+// Parse creates a schedule from config values. Cron expression takes precedence over interval.
+// Returns nil schedule if both are empty.
+func Parse(interval string, cron string) (Schedule, error) {
+	if cron != "" {
+		return ParseCron(cron)
+	}
+	if interval != "" {
+		duration, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, err
+		}
+		if duration < time.Minute {
+			return nil, errors.New("Refresh interval must be at least one minute")
+		}
+		return Interval(duration), nil
+	}
+	return nil, nil
+}
+
+// ParseCron parses a five field cron expression.
+func ParseCron(spec string) (cron *Cron, err error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("Invalid cron expression. Expected 5 fields: " + spec)
+	}
+	cron = &Cron{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	if cron.minutes, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cron.hours, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cron.daysOfMonth, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cron.months, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if cron.daysOfWeek, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if cron.daysOfWeek[7] {
+		cron.daysOfWeek[0] = true
+	}
+	return cron, nil
+}
+
+func parseField(field string, min int, max int) (values map[int]bool, err error) {
+	values = make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		stepped := false
+		if i := strings.Index(part, "/"); i >= 0 {
+			stepped = true
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, errors.New("Invalid cron step: " + part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.New("Invalid cron value: " + part)
+			}
+			// N/step is N-max/step
+			to = from
+			if stepped {
+				to = max
+			}
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New("Invalid cron value: " + part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, errors.New("Cron value out of range: " + part)
+		}
+		for value := from; value <= to; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+func (cron *Cron) matchesDay(t time.Time) bool {
+	dayOfMonth := cron.daysOfMonth[t.Day()]
+	dayOfWeek := cron.daysOfWeek[int(t.Weekday())]
+	// Like standard cron, if both day fields are restricted either of them may match
+	if !cron.anyDay && !cron.anyWeekday {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
+
+// Next - Gets next matching minute after given time. Returns zero time if nothing matches in five years.
+func (cron *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !cron.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Run calls job at every scheduled time, forever. Runs never overlap.
+func Run(name string, schedule Schedule, job func()) {
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			logging.Warn("Schedule of " + name + " never matches, stopping")
+			return
+		}
+		logging.Info("Next " + name + " is at " + next.Format("2006-01-02 15:04:05"))
+		time.Sleep(time.Until(next))
+		job()
+	}
+}
@@ -0,0 +1,43 @@
+package scheduler
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseField(t *testing.T) {
+	tests := []struct {
+		field   string
+		min     int
+		max     int
+		values  []int
+		wantErr bool
+	}{
+		{field: "5", min: 0, max: 59, values: []int{5}},
+		{field: "1,3", min: 0, max: 59, values: []int{1, 3}},
+		{field: "1-4", min: 0, max: 59, values: []int{1, 2, 3, 4}},
+		{field: "*/15", min: 0, max: 59, values: []int{0, 15, 30, 45}},
+		{field: "5/10", min: 0, max: 59, values: []int{5, 15, 25, 35, 45, 55}},
+		{field: "10-30/10", min: 0, max: 59, values: []int{10, 20, 30}},
+		{field: "20/2", min: 0, max: 23, values: []int{20, 22}},
+		{field: "60", min: 0, max: 59, wantErr: true},
+		{field: "5/0", min: 0, max: 59, wantErr: true},
+		{field: "4-1", min: 0, max: 59, wantErr: true},
+	}
+	for _, test := range tests {
+		values, err := parseField(test.field, test.min, test.max)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseField(%q) error = %v, wantErr %v", test.field, err, test.wantErr)
+			continue
+		}
+		var got []int
+		for value := range values {
+			got = append(got, value)
+		}
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, test.values) {
+			t.Errorf("parseField(%q) = %v, want %v", test.field, got, test.values)
+		}
+	}
+}
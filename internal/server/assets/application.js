@@ -604,7 +604,7 @@ atv.onGenerateRequest = function (request) {
 // to load the root page. If atv.config.doesJavaScriptLoadRoot is false, the next likely method that will be called
 // is atv.onGenerateRequest to decorate the URL for the root plist.
 atv.onAppEntry = function () {
-  atvutils.loadURL("https://appletv.redbull.tv");
+  atvutils.loadURL(basePath);
 }
 
 // atv.onAppExit
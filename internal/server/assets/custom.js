@@ -119,7 +119,7 @@ function editM3UAddress(title, instructions, label, footnote, defaultValue) {
   var label2 = document.getElementById("edit-m3u").getElementByTagName('label2');
   textEntry.onSubmit = function (value) {
     ajax = new ATVUtils.Ajax({
-      "url": "https://appletv.redbull.tv/set-m3u.xml?m3u=" + value,
+      "url": basePath + "/set-m3u.xml?m3u=" + value,
       "method": "POST",
       "success": function (xhr) {
         label2.textContent = value;
@@ -133,4 +133,17 @@ function editM3UAddress(title, instructions, label, footnote, defaultValue) {
     label2.textContent = defaultValue;
   }
   textEntry.show();
+}
+
+function goToChannelNumber(title, instructions, label) {
+  var textEntry = new atv.TextEntry();
+  textEntry.type = 'emailAddress';
+  textEntry.title = title;
+  textEntry.instructions = instructions;
+  textEntry.label = label;
+  textEntry.defaultToAppleID = false;
+  textEntry.onSubmit = function (value) {
+    atvutils.loadURL(basePath + "/player.xml?number=" + encodeURIComponent(value));
+  }
+  textEntry.show();
 }
\ No newline at end of file
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ghokun/appletv3-iptv/internal/m3u"
+)
+
+// Proxied channels are fetched by appletv3-iptv and relayed to Apple TV. HLS playlists are
+// rewritten so that variant playlists, keys and segments are fetched through the proxy too.
+const (
+	proxyPlaylistPath = "/proxy/playlist.m3u8"
+	proxySegmentPath  = "/proxy/segment"
+)
+
+var (
+	proxyClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 15 * time.Second,
+			MaxIdleConnsPerHost:   8,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+	uriAttributeRegExp = regexp.MustCompile(`URI="([^"]*)"`)
+	// Headers that are relayed from upstream for segments
+	relayedHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "ETag"}
+	// Addresses in rewritten playlists are signed with a key that is generated at startup, so that
+	// the proxy only fetches addresses that it has handed out itself
+	proxyKey = newProxyKey()
+)
+
+func newProxyKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// signProxyURL returns signature of an address for a channel.
+func signProxyURL(channel m3u.Channel, target string) string {
+	mac := hmac.New(sha256.New, proxyKey)
+	io.WriteString(mac, channel.CategoryID+"\n"+channel.ID+"\n"+target)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyProxyURL - Was address handed out for channel by rewritePlaylist?
+func verifyProxyURL(channel m3u.Channel, target string, signature string) bool {
+	decoded, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(signProxyURL(channel, target))
+	return hmac.Equal(decoded, expected)
+}
+
+// proxyHandler https://appletv.redbull.tv/proxy/playlist.m3u8?category=..&channel=..[&url=..&sig=..]
+// Fetches media URL of channel, or given url, which must be signed by rewritePlaylist for that channel.
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Unsupported operation", http.StatusMethodNotAllowed)
+		return
+	}
+	category := r.URL.Query().Get("category")
+	channelID := r.URL.Query().Get("channel")
+	channel, err := m3u.GetPlaylist().GetChannel(category, channelID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !channel.UsesProxy() {
+		http.Error(w, "Channel is not streamed through appletv3-iptv", http.StatusForbidden)
+		return
+	}
+	target := channel.MediaURL
+	if value := r.URL.Query().Get("url"); value != "" {
+		if !verifyProxyURL(channel, value, r.URL.Query().Get("sig")) {
+			http.Error(w, "Address is not a playlist or segment of channel", http.StatusForbidden)
+			return
+		}
+		target = value
+	}
+
+	request, err := http.NewRequestWithContext(r.Context(), r.Method, target, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// #EXTVLCOPT and #KODIPROP headers, like User-Agent and Referer
+	request.Header = channel.GetHTTPHeaders()
+	if value := r.Header.Get("Range"); value != "" {
+		request.Header.Set("Range", value)
+	}
+	response, err := proxyClient.Do(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	reader := bufio.NewReader(response.Body)
+	if response.StatusCode >= 200 && response.StatusCode < 300 && isPlaylist(response, reader) {
+		// Relative addresses are resolved against final address, after redirects
+		playlist := rewritePlaylist(reader, response.Request.URL, channel)
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		io.WriteString(w, playlist)
+		return
+	}
+	for _, header := range relayedHeaders {
+		if value := response.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, reader)
+}
+
+func isPlaylist(response *http.Response, reader *bufio.Reader) bool {
+	if strings.Contains(strings.ToLower(response.Header.Get("Content-Type")), "mpegurl") {
+		return true
+	}
+	header, _ := reader.Peek(len("#EXTM3U"))
+	return string(header) == "#EXTM3U"
+}
+
+// rewritePlaylist replaces every address in an HLS playlist with a proxy address.
+func rewritePlaylist(reader io.Reader, base *url.URL, channel m3u.Channel) string {
+	var builder strings.Builder
+	nextIsPlaylist := false
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			// Alternative renditions and i-frame playlists are playlists, keys and init sections are not
+			attributeIsPlaylist := strings.HasPrefix(line, "#EXT-X-MEDIA") || strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF")
+			line = uriAttributeRegExp.ReplaceAllStringFunc(line, func(attribute string) string {
+				uri := uriAttributeRegExp.FindStringSubmatch(attribute)[1]
+				return `URI="` + proxyURL(base, uri, channel, attributeIsPlaylist) + `"`
+			})
+			if strings.HasPrefix(line, "#EXT-X-STREAM-INF") {
+				nextIsPlaylist = true
+			}
+		default:
+			line = proxyURL(base, line, channel, nextIsPlaylist)
+			nextIsPlaylist = false
+		}
+		builder.WriteString(line)
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// proxyURL returns signed proxy address of an address in a playlist. Returned address is relative to server
+// root, so it works with whatever host name Apple TV used for fetching playlist.
+func proxyURL(base *url.URL, uri string, channel m3u.Channel, playlist bool) string {
+	resolved, err := base.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	// Data URIs, for example inline keys, do not need proxying
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return uri
+	}
+	path := proxySegmentPath
+	if playlist || strings.HasSuffix(strings.ToLower(resolved.Path), ".m3u8") || strings.HasSuffix(strings.ToLower(resolved.Path), ".m3u") {
+		path = proxyPlaylistPath
+	}
+	return path + "?category=" + url.QueryEscape(channel.CategoryID) +
+		"&channel=" + url.QueryEscape(channel.ID) +
+		"&url=" + url.QueryEscape(resolved.String()) +
+		"&sig=" + signProxyURL(channel, resolved.String())
+}
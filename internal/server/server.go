@@ -1,7 +1,9 @@
 package server
 
 import (
+	"crypto/tls"
 	"embed"
+	"fmt"
 	"net/http"
 
 	"github.com/ghokun/appletv3-iptv/internal/appletv"
@@ -17,9 +19,53 @@ func serveHTTP(mux *http.ServeMux, errs chan<- error) {
 	errs <- http.ListenAndServe(port, mux)
 }
 
+// serveHTTPS serves certificates of all hijacked apps, certificate is selected by server name in TLS handshake.
 func serveHTTPS(mux *http.ServeMux, errs chan<- error) {
-	port := ":" + config.Current.HTTPSPort
-	errs <- http.ListenAndServeTLS(port, config.Current.PemPath, config.Current.KeyPath, mux)
+	tlsConfig := &tls.Config{}
+	for _, app := range config.Current.GetApps() {
+		certificate, err := tls.LoadX509KeyPair(app.PemPath, app.KeyPath)
+		if err != nil {
+			errs <- err
+			return
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, certificate)
+	}
+	server := &http.Server{
+		Addr:      ":" + config.Current.HTTPSPort,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	errs <- server.ListenAndServeTLS("", "")
+}
+
+// applicationScriptHandler serves application.js with base path of request, which is the address
+// that application loads when it is opened.
+func applicationScriptHandler(w http.ResponseWriter, r *http.Request) {
+	contents, err := assets.ReadFile("assets/application.js")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	fmt.Fprintf(w, "var basePath = %q;\n", appletv.GetBasePath(r))
+	w.Write(contents)
+}
+
+// menuIconHandler serves icon file of app in config, or bundled icon if it is not set.
+func menuIconHandler(icon func(app config.App) string, bundled string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if path := icon(appletv.GetApp(r)); path != "" {
+			http.ServeFile(w, r, path)
+			return
+		}
+		contents, err := assets.ReadFile(bundled)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(contents)
+	}
 }
 
 func Serve() {
@@ -28,23 +74,38 @@ func Serve() {
 
 	// Serve static files
 	mux.Handle("/assets/", http.FileServer(http.FS(assets)))
+	mux.HandleFunc("/assets/application.js", applicationScriptHandler)
 	mux.Handle("/logo/", http.StripPrefix("/logo/", http.FileServer(http.Dir(".cache/logo"))))
+	// Certificate and icons of app that request is sent to
 	mux.HandleFunc("/redbulltv.cer", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, config.Current.CerPath)
+		http.ServeFile(w, r, appletv.GetApp(r).CerPath)
 	})
+	mux.HandleFunc("/menu-icon-720.png", menuIconHandler(func(app config.App) string { return app.MenuIcon720 }, "assets/images/menu_icon_720.png"))
+	mux.HandleFunc("/menu-icon-1080.png", menuIconHandler(func(app config.App) string { return app.MenuIcon1080 }, "assets/images/menu_icon_1080.png"))
+
+	// Relay streams of proxied channels
+	mux.HandleFunc(proxyPlaylistPath, proxyHandler)
+	mux.HandleFunc(proxySegmentPath, proxyHandler)
 
 	// Serve apple tv pages and functions
 	mux.HandleFunc("/", appletv.MainHandler)
+	mux.HandleFunc("/bag.plist", appletv.BagHandler)
 
 	// Channels
 	mux.HandleFunc("/channels.xml", appletv.ChannelsHandler)
+	mux.HandleFunc("/channel.xml", appletv.ChannelHandler)
 	mux.HandleFunc("/channel-options.xml", appletv.ChannelOptionsHandler)
 	mux.HandleFunc("/recent.xml", appletv.RecentHandler)
 	mux.HandleFunc("/favorites.xml", appletv.FavoritesHandler)
 	mux.HandleFunc("/toggle-favorite.xml", appletv.ToggleFavoriteHandler)
+	mux.HandleFunc("/toggle-proxy.xml", appletv.ToggleProxyHandler)
 	mux.HandleFunc("/category.xml", appletv.CategoryHandler)
+	mux.HandleFunc("/category-index.xml", appletv.CategoryIndexHandler)
 	mux.HandleFunc("/player.xml", appletv.PlayerHandler)
 
+	// Programme guide
+	mux.HandleFunc("/guide.xml", appletv.GuideHandler)
+
 	// Search
 	mux.HandleFunc("/search.xml", appletv.SearchHandler)
 	mux.HandleFunc("/search-results.xml", appletv.SearchResultsHandler)
@@ -53,9 +114,13 @@ func Serve() {
 	mux.HandleFunc("/settings.xml", appletv.SettingsHandler)
 	mux.HandleFunc("/set-m3u.xml", appletv.SetM3UHandler)
 	mux.HandleFunc("/reload-channels.xml", appletv.ReloadChannelsHandler)
+	mux.HandleFunc("/toggle-source.xml", appletv.ToggleSourceHandler)
+	mux.HandleFunc("/toggle-language.xml", appletv.ToggleLanguageHandler)
 	mux.HandleFunc("/clear-recent.xml", appletv.ClearRecentHandler)
 	mux.HandleFunc("/clear-favorites.xml", appletv.ClearFavoritesHandler)
+	mux.HandleFunc("/clear-logo-cache.xml", appletv.ClearLogoCacheHandler)
 	mux.HandleFunc("/logs.xml", appletv.LogsHandler)
+	mux.HandleFunc("/blocked-lookups.xml", appletv.BlockedLookupsHandler)
 
 	httpErrs := make(chan error, 1)
 	go serveHTTP(mux, httpErrs)
@@ -6,9 +6,14 @@ import (
 	"log"
 	"os"
 
+	"github.com/ghokun/appletv3-iptv/internal/appletv"
+	"github.com/ghokun/appletv3-iptv/internal/cert"
 	"github.com/ghokun/appletv3-iptv/internal/config"
+	"github.com/ghokun/appletv3-iptv/internal/dns"
+	"github.com/ghokun/appletv3-iptv/internal/epg"
 	"github.com/ghokun/appletv3-iptv/internal/logging"
 	"github.com/ghokun/appletv3-iptv/internal/m3u"
+	"github.com/ghokun/appletv3-iptv/internal/scheduler"
 	"github.com/ghokun/appletv3-iptv/internal/server"
 )
 
@@ -16,6 +21,7 @@ func main() {
 
 	configFilePtr := flag.String("config", "config.yaml", "Config file path")
 	versionPtr := flag.Bool("v", false, "prints current application version")
+	templatesPtr := flag.String("templates", "", "Templates directory, read on every request instead of built-in templates. For editing templates")
 	flag.Parse()
 
 	if *versionPtr {
@@ -28,18 +34,87 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// appletv3-iptv [-config config.yaml] cert generate
+	if flag.Arg(0) == "cert" {
+		if flag.Arg(1) != "generate" {
+			log.Fatal("Unknown command. Usage: appletv3-iptv [-config config.yaml] cert generate")
+		}
+		err := cert.GenerateAll()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	if config.Current.LogToFile {
 		logging.EnableLoggingToFile()
 	}
 
 	logging.Info("Starting appletv3-iptv")
 
-	if config.Current.M3UPath != "" {
+	err = cert.EnsureExists()
+	if err != nil {
+		logging.Fatal(err)
+	}
+	cert.CheckExpiry()
+
+	err = appletv.LoadTemplates(*templatesPtr)
+	if err != nil {
+		logging.Fatal(err)
+	}
+	appletv.CheckTranslations()
+
+	if len(config.Current.GetSources()) > 0 {
 		err := m3u.GeneratePlaylist()
 		if err != nil {
 			logging.Warn(err)
 		}
 	}
 
+	// EPG files may be large, do not block startup
+	go reloadGuide()
+
+	refreshSchedule, err := scheduler.Parse(config.Current.RefreshInterval, config.Current.RefreshSchedule)
+	if err != nil {
+		logging.Warn("Automatic channel refresh is disabled. " + err.Error())
+	} else if refreshSchedule != nil {
+		go scheduler.Run("channel refresh", refreshSchedule, func() {
+			if len(config.Current.GetSources()) == 0 {
+				return
+			}
+			// Errors are logged, previous channel list is kept
+			if m3u.RefreshPlaylist() == nil {
+				reloadGuide()
+			}
+		})
+	}
+
+	// Sources with their own refresh policy are reloaded separately
+	for _, source := range config.Current.Sources {
+		sourceSchedule, err := scheduler.Parse(source.RefreshInterval, source.RefreshSchedule)
+		if err != nil {
+			logging.Warn("Automatic refresh of source " + source.Name + " is disabled. " + err.Error())
+		} else if sourceSchedule != nil {
+			name := source.Name
+			go scheduler.Run("refresh of source "+name, sourceSchedule, func() {
+				if m3u.ReloadSource(name) == nil {
+					reloadGuide()
+				}
+			})
+		}
+	}
+
+	err = dns.Start()
+	if err != nil {
+		logging.Warn("DNS server could not be started. " + err.Error())
+	}
+
 	server.Serve()
 }
+
+func reloadGuide() {
+	err := epg.GenerateGuide(m3u.GetPlaylist().GetEPGPath())
+	if err != nil {
+		logging.Warn(err)
+	}
+}